@@ -1,6 +1,8 @@
 package adapter
 
 import (
+	"context"
+	"sync"
 	"time"
 
 	"github.com/lodastack/alarm-adapter/config"
@@ -11,32 +13,91 @@ import (
 const defaultInterval = 1
 const updateInterval = 3
 
+var (
+	runningmu sync.Mutex
+	running   *Kapacitor
+)
+
 func Start() {
 	if !config.C.Alarm.Enable {
 		log.Infof("alarm module not enabled")
 		return
 	}
-	r := NewRegistry(config.C.Main.RegistryAddr, config.C.Alarm.NS)
+	r := NewRegistry(config.C.Main.RegistryAddr, config.C.Alarm.NS, config.C.Alarm.Root)
 	servers, err := r.AlarmServers()
 	if err != nil {
 		panic(err)
 	}
-	k := NewKapacitor(servers, config.C.Alarm.EventAddr)
+	failPolicy := FailClosed
+	if config.C.Alarm.FailOpen {
+		failPolicy = FailOpen
+	}
+	removePolicy := RemoveAll
+	if config.C.Alarm.RemoveOwnerOnly {
+		removePolicy = RemoveOwner
+	}
+	var hashKey func(alarm Alarm) string
+	if config.C.Alarm.HashKey == "measurement" {
+		hashKey = HashByMeasurement
+	}
+	k, err := NewKapacitorWithOptions(servers, config.C.Alarm.EventAddr, Options{
+		Timeout:            time.Duration(config.C.Alarm.Timeout) * time.Second,
+		TLS:                config.C.Alarm.TLS,
+		InsecureSkipVerify: config.C.Alarm.InsecureSkipVerify,
+		CACert:             config.C.Alarm.CACert,
+		Cert:               config.C.Alarm.Cert,
+		Key:                config.C.Alarm.Key,
+		Username:           config.C.Alarm.Username,
+		Password:           config.C.Alarm.Password,
+		Token:              config.C.Alarm.Token,
+		UserAgent:          config.C.Alarm.UserAgent,
+		MaxConcurrency:     config.C.Alarm.MaxConcurrency,
+		MaxAttempts:        config.C.Alarm.MaxAttempts,
+		RetryDelay:         time.Duration(config.C.Alarm.RetryDelay) * time.Millisecond,
+		Replicas:           config.C.Alarm.Replicas,
+		Weights:            config.C.Alarm.Weights,
+		Root:               config.C.Alarm.Root,
+		Timezone:           config.C.Alarm.Timezone,
+		FailPolicy:         failPolicy,
+		RemovePolicy:       removePolicy,
+		PostTimeout:        time.Duration(config.C.Alarm.PostTimeout) * time.Second,
+		CaptureResponse:    config.C.Alarm.CaptureResponse,
+		GroupID:            config.C.Alarm.GroupID,
+		Jitter:             time.Duration(config.C.Alarm.Jitter) * time.Second,
+		Topic:              config.C.Alarm.Topic,
+		HashKey:            hashKey,
+		VerifyCreate:       config.C.Alarm.VerifyCreate,
+		Offset:             config.C.Alarm.Offset,
+		FallbackEventAddr:  config.C.Alarm.FallbackEventAddr,
+		NodeHeader:         config.C.Alarm.NodeHeader,
+		Stagger:            config.C.Alarm.Stagger,
+		Environment:        config.C.Alarm.Environment,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	runningmu.Lock()
+	running = k
+	runningmu.Unlock()
 
 	go updateAlarmServers(k, r)
-	ticker := time.NewTicker(time.Duration(defaultInterval) * time.Minute)
-	for {
-		select {
-		case <-ticker.C:
-			tasks := k.Tasks()
-			alarms, err := r.Alarms()
-			if err != nil {
-				log.Errorf("get alarms failed:%s", err)
-			} else {
-				go k.Work(tasks, alarms)
-			}
-		}
+	go k.HealthCheck(time.Duration(config.C.Alarm.HealthCheckInterval) * time.Second)
+	k.Run(context.Background(), r.Alarms, time.Duration(defaultInterval)*time.Minute)
+}
+
+// Stop shuts down the adapter started by Start, the in-flight
+// task changes are waited up to timeout.
+func Stop(timeout time.Duration) error {
+	runningmu.Lock()
+	k := running
+	runningmu.Unlock()
+	if k == nil {
+		return nil
 	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return k.Shutdown(ctx)
 }
 
 func updateAlarmServers(k *Kapacitor, r *Registry) {
@@ -46,8 +107,9 @@ func updateAlarmServers(k *Kapacitor, r *Registry) {
 		case <-ticker.C:
 			servers, err := r.AlarmServers()
 			if err == nil {
-				k.SetAddr(servers)
-			} else {
+				err = k.SetAddr(servers)
+			}
+			if err != nil {
 				log.Error(err)
 			}
 		}
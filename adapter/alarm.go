@@ -0,0 +1,148 @@
+package adapter
+
+import (
+	"github.com/lodastack/models"
+)
+
+// Alarm is the alarm pulled from registry.
+// It extends models.Alarm with the options only the adapter cares about.
+type Alarm struct {
+	models.Alarm
+
+	// kapacitor task ID surviving the version bumps, so the task history
+	// and stats persist, default Version. It must be under the root prefix
+	// like the versions, the event address still gets the Version.
+	TaskID string `json:"taskid"`
+
+	// deadman threshold (points per interval) and interval, e.g. "0.0" and "5m"
+	DeadmanThreshold string `json:"deadmanthreshold"`
+	DeadmanInterval  string `json:"deadmaninterval"`
+
+	// warn level, the expression falls back to the crit one if empty
+	WarnExpression string `json:"warnexpression"`
+	WarnValue      string `json:"warnvalue"`
+	// declare the values as the TICK vars crit and warn, the task is
+	// created with the vars and a change of the values only updates them
+	// by UpdateVars without replacing the script
+	VarThreshold bool `json:"varthreshold"`
+
+	// post the alert to it instead of the global event address
+	EventAddr string `json:"eventaddr"`
+
+	// kapacitor handler of the alert, default HandlerPost to the event address,
+	// the target is the tcp address, exec command or topic of the other handlers
+	Handler       string `json:"handler"`
+	HandlerTarget string `json:"handlertarget"`
+
+	// extra database and retention policy pairs the task registers,
+	// the query still targets DB and RP
+	DBRPs []DBRP `json:"dbrps"`
+
+	// more measurements of DB and RP queried together with Measurement.
+	// Each measurement is a series of its own, the alert checks the
+	// threshold per measurement and group, the values are not aggregated
+	// across the measurements.
+	Measurements []string `json:"measurements"`
+
+	// group by time window and its offset for the write latency,
+	// default 1m and 5s
+	Window string `json:"window"`
+	Offset string `json:"offset"`
+	// group by the plain time window without the offset and the alignment,
+	// e.g. for the long periods the 5s offset shifts the buckets
+	NoAlign bool `json:"noalign"`
+	// delay of the evaluation after the aligned boundaries under 1m, e.g.
+	// "17s", to spread the load of the node, derived from the task ID if
+	// the Stagger option is set
+	Stagger string `json:"stagger"`
+
+	// extra arguments of the threshold func, e.g. "95" for percentile
+	FuncArgs string `json:"funcargs"`
+
+	// field of the measurement to query, default "value"
+	Field string `json:"field"`
+
+	// how the relative trigger computes the diff, default RelativeMaxMin
+	RelativeMode string `json:"relativemode"`
+
+	// rate of the TriggerDerivative trigger per unit, default 1s, e.g. of
+	// the counters, the negative rates of the counter resets are dropped
+	// with NonNegative
+	DerivativeUnit string `json:"derivativeunit"`
+	NonNegative    bool   `json:"nonnegative"`
+
+	// weekdays the alert is on, 0 is Sunday, in the kapacitor timezone,
+	// every day if empty. STime and ETime apply to each of the days.
+	Weekdays []int `json:"weekdays"`
+
+	// maintenance windows muting the alert whatever the other settings,
+	// e.g. STime and ETime
+	Maintenance []Window `json:"maintenance"`
+
+	// only alert if the value breaches the level in the number of
+	// consecutive points, i.e. time windows, default 1. The count goes on
+	// across the evaluations, so N > 1 needs Every equal to Period for the
+	// windows not to overlap, e.g. a 5m period of 1m windows with N 3 alerts
+	// on 3 breaching windows in a row, maybe of two evaluations.
+	Consecutive int `json:"consecutive"`
+
+	// only alert on state changes, e.g. OK to CRIT and CRIT to OK
+	StateChangesOnly bool `json:"statechangesonly"`
+
+	// flapping thresholds between 0 and 1, suppress the flapping series
+	FlappingLow  string `json:"flappinglow"`
+	FlappingHigh string `json:"flappinghigh"`
+
+	// don't post the recovery events
+	NoRecoveries bool `json:"norecoveries"`
+
+	// alert message and details templates, kapacitor template variables
+	// like {{ .Level }} and {{ index .Tags "host" }} are kept as they are
+	Message string `json:"message"`
+	Details string `json:"details"`
+
+	// static tags of the alerts for routing, e.g. team and service, set by
+	// a default node before the alert. They are posted in the tags of the
+	// series, data.series[].tags of the alert body, a metric tag of the
+	// same name wins. The deadman alerts don't carry them.
+	AlertTags map[string]string `json:"alerttags"`
+}
+
+// TriggerDerivative alerts on the rate of change between the time windows
+// of the func, default last, e.g. of a counter. The other triggers are the
+// ones of models.
+const TriggerDerivative = "derivative"
+
+// relative trigger modes
+const (
+	// max - min of the period
+	RelativeMaxMin = "maxmin"
+	// last - first of the period
+	RelativeLastFirst = "lastfirst"
+	// change of the window mean from the previous window
+	RelativeMean = "mean"
+	// change percent of the window mean from the one a period earlier
+	RelativePercent = "percent"
+)
+
+// alert handlers
+const (
+	HandlerPost  = "post"
+	HandlerTCP   = "tcp"
+	HandlerExec  = "exec"
+	HandlerTopic = "topic"
+)
+
+// Window is a wall clock window in the kapacitor timezone from Start to End,
+// hours or HH:MM like STime and ETime, on the Weekdays, 0 is Sunday, or every
+// day if empty. A window across midnight ends on the next day.
+type Window struct {
+	Start    string `json:"start"`
+	End      string `json:"end"`
+	Weekdays []int  `json:"weekdays"`
+}
+
+type DBRP struct {
+	DB string `json:"db"`
+	RP string `json:"rp"`
+}
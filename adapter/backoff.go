@@ -0,0 +1,115 @@
+package adapter
+
+import (
+	"hash/fnv"
+	"time"
+
+	"github.com/lodastack/log"
+)
+
+// backoff of the creates of a failing version, doubled per failure
+const (
+	defaultCreateBackoff = time.Minute
+	maxCreateBackoff     = time.Hour
+)
+
+// StuckAlarm is a version whose task fails to create, e.g. an invalid
+// TICK script, Work doesn't retry it until NextRetry.
+type StuckAlarm struct {
+	Failures  int
+	LastError error
+	NextRetry time.Time
+
+	// sum of the script failing to create
+	script uint32
+}
+
+// Stuck returns the versions failing to create keyed by the version,
+// the alarms need fixing. The registry may fix an alarm under the same
+// version, the backoff is dropped once its script changes, so the next
+// Work retries it.
+func (k *Kapacitor) Stuck() map[string]StuckAlarm {
+	k.backoffmu.Lock()
+	defer k.backoffmu.Unlock()
+	stuck := make(map[string]StuckAlarm, len(k.createFails))
+	for version, s := range k.createFails {
+		stuck[version] = *s
+	}
+	return stuck
+}
+
+// createFailed records the failed create of the alarm and backs it off.
+func (k *Kapacitor) createFailed(alarm Alarm, err error) {
+	script := k.scriptSum(alarm)
+	k.backoffmu.Lock()
+	defer k.backoffmu.Unlock()
+	if k.createFails == nil {
+		k.createFails = make(map[string]*StuckAlarm)
+	}
+	s, ok := k.createFails[alarm.Version]
+	if !ok || s.script != script {
+		s = &StuckAlarm{script: script}
+		k.createFails[alarm.Version] = s
+	}
+	s.Failures++
+	s.LastError = err
+	backoff := maxCreateBackoff
+	if s.Failures <= 6 {
+		backoff = defaultCreateBackoff << uint(s.Failures-1)
+	}
+	s.NextRetry = time.Now().Add(backoff)
+}
+
+// createDone forgets the failures of the created alarm.
+func (k *Kapacitor) createDone(alarm Alarm) {
+	k.backoffmu.Lock()
+	defer k.backoffmu.Unlock()
+	delete(k.createFails, alarm.Version)
+}
+
+// backedOff reports whether the create of the alarm waits for its retry,
+// a changed script of the version is retried at once.
+func (k *Kapacitor) backedOff(alarm Alarm) bool {
+	script := k.scriptSum(alarm)
+	k.backoffmu.Lock()
+	defer k.backoffmu.Unlock()
+	s, ok := k.createFails[alarm.Version]
+	if !ok {
+		return false
+	}
+	if s.script != script {
+		delete(k.createFails, alarm.Version)
+		return false
+	}
+	if !time.Now().Before(s.NextRetry) {
+		return false
+	}
+	log.Debugf("skip backed off create version=%s failures=%d next_retry=%s", alarm.Version, s.Failures, s.NextRetry)
+	return true
+}
+
+// scriptSum sums the script of the alarm, or the error of generating it.
+func (k *Kapacitor) scriptSum(alarm Alarm) uint32 {
+	tick, err := k.genTick(alarm)
+	if err != nil {
+		tick = err.Error()
+	}
+	h := fnv.New32a()
+	h.Write([]byte(tick))
+	return h.Sum32()
+}
+
+// pruneBackoff forgets the failures of the versions no longer in alarms.
+func (k *Kapacitor) pruneBackoff(alarms map[string]Alarm) {
+	versions := make(map[string]bool, len(alarms))
+	for _, alarm := range alarms {
+		versions[alarm.Version] = true
+	}
+	k.backoffmu.Lock()
+	defer k.backoffmu.Unlock()
+	for version := range k.createFails {
+		if !versions[version] {
+			delete(k.createFails, version)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package adapter
+
+import (
+	"time"
+
+	"github.com/influxdata/kapacitor/client/v1"
+)
+
+// Client is the part of the kapacitor client used by the adapter,
+// *client.Client implements it and tests can replace it with a fake one.
+type Client interface {
+	Ping() (time.Duration, string, error)
+
+	TaskLink(id string) client.Link
+	Task(link client.Link, opt *client.TaskOptions) (client.Task, error)
+	ListTasks(opt *client.ListTasksOptions) ([]client.Task, error)
+	CreateTask(opt client.CreateTaskOptions) (client.Task, error)
+	UpdateTask(link client.Link, opt client.UpdateTaskOptions) (client.Task, error)
+	DeleteTask(link client.Link) error
+
+	TopicHandlersLink(topic string) client.Link
+	TopicHandlerLink(topic, id string) client.Link
+	CreateTopicHandler(link client.Link, opt client.TopicHandlerOptions) (client.TopicHandler, error)
+	ReplaceTopicHandler(link client.Link, opt client.TopicHandlerOptions) (client.TopicHandler, error)
+}
+
+var _ Client = (*client.Client)(nil)
+
+// newClient creates the client of a node with k.NewClient,
+// the kapacitor client is used by default.
+func (k *Kapacitor) newClient(config client.Config) (Client, error) {
+	if k.NewClient != nil {
+		return k.NewClient(config)
+	}
+	return client.New(config)
+}
@@ -19,6 +19,9 @@ func (x uints) Less(i, j int) bool { return x[i] < x[j] }
 // Swap exchanges elements i and j.
 func (x uints) Swap(i, j int) { x[i], x[j] = x[j], x[i] }
 
+// default number of replicas for each entry
+const defaultReplicas = 20
+
 // ErrEmptyCircle is the error returned when trying to get an element when nothing has been added to hash.
 var ErrEmptyCircle = errors.New("empty circle")
 
@@ -26,6 +29,7 @@ var ErrEmptyCircle = errors.New("empty circle")
 type Consistent struct {
 	circle           map[uint32]string
 	members          map[string]bool
+	weights          map[string]int
 	sortedHashes     uints
 	NumberOfReplicas int
 	count            int64
@@ -37,10 +41,20 @@ type Consistent struct {
 //
 // To change the number of replicas, set NumberOfReplicas before adding entries.
 func NewConsistent() *Consistent {
+	return NewConsistentWithReplicas(defaultReplicas)
+}
+
+// NewConsistentWithReplicas creates a new Consistent object with n replicas for each entry,
+// n less than 1 falls back to the default 20.
+func NewConsistentWithReplicas(n int) *Consistent {
+	if n < 1 {
+		n = defaultReplicas
+	}
 	c := new(Consistent)
-	c.NumberOfReplicas = 20
+	c.NumberOfReplicas = n
 	c.circle = make(map[uint32]string)
 	c.members = make(map[string]bool)
+	c.weights = make(map[string]int)
 	return c
 }
 
@@ -54,15 +68,32 @@ func (c *Consistent) eltKey(elt string, idx int) string {
 func (c *Consistent) Add(elt string) {
 	c.Lock()
 	defer c.Unlock()
-	c.add(elt)
+	c.add(elt, 1)
+}
+
+// AddWithWeight inserts a string element with weight times of NumberOfReplicas
+// in the consistent hash, so it gets weight times of the keys.
+// Weight less than 1 is taken as 1.
+func (c *Consistent) AddWithWeight(elt string, weight int) {
+	c.Lock()
+	defer c.Unlock()
+	c.add(elt, weight)
 }
 
 // need c.Lock() before calling
-func (c *Consistent) add(elt string) {
-	for i := 0; i < c.NumberOfReplicas; i++ {
+func (c *Consistent) add(elt string, weight int) {
+	// re-adding a member replaces its replicas, it is still counted once
+	if c.members[elt] {
+		c.remove(elt)
+	}
+	if weight < 1 {
+		weight = 1
+	}
+	for i := 0; i < c.NumberOfReplicas*weight; i++ {
 		c.circle[c.hashKey(c.eltKey(elt, i))] = elt
 	}
 	c.members[elt] = true
+	c.weights[elt] = weight
 	c.updateSortedHashes()
 	c.count++
 }
@@ -76,10 +107,18 @@ func (c *Consistent) Remove(elt string) {
 
 // need c.Lock() before calling
 func (c *Consistent) remove(elt string) {
-	for i := 0; i < c.NumberOfReplicas; i++ {
+	if !c.members[elt] {
+		return
+	}
+	weight := c.weights[elt]
+	if weight < 1 {
+		weight = 1
+	}
+	for i := 0; i < c.NumberOfReplicas*weight; i++ {
 		delete(c.circle, c.hashKey(c.eltKey(elt, i)))
 	}
 	delete(c.members, elt)
+	delete(c.weights, elt)
 	c.updateSortedHashes()
 	c.count--
 }
@@ -106,7 +145,7 @@ func (c *Consistent) Set(elts []string) {
 		if exists {
 			continue
 		}
-		c.add(v)
+		c.add(v, 1)
 	}
 }
 
@@ -0,0 +1,53 @@
+package adapter
+
+import (
+	"sort"
+	"testing"
+)
+
+func TestConsistentCount(t *testing.T) {
+	tests := []struct {
+		name string
+		ops  func(c *Consistent)
+		want []string
+	}{
+		{"remove twice", func(c *Consistent) { c.Remove("b"); c.Remove("b") }, []string{"a", "c"}},
+		{"remove a non member", func(c *Consistent) { c.Remove("d") }, []string{"a", "b", "c"}},
+		{"add twice", func(c *Consistent) { c.Add("a"); c.AddWithWeight("a", 2) }, []string{"a", "b", "c"}},
+		{"remove all and add back", func(c *Consistent) {
+			c.Remove("a")
+			c.Remove("b")
+			c.Remove("c")
+			c.Remove("c")
+			c.Add("b")
+		}, []string{"b"}},
+	}
+	for _, tt := range tests {
+		c := NewConsistent()
+		for _, elt := range []string{"a", "b", "c"} {
+			c.Add(elt)
+		}
+		tt.ops(c)
+		if c.count != int64(len(tt.want)) {
+			t.Errorf("%s: got count %d, want %d", tt.name, c.count, len(tt.want))
+		}
+		members := c.Members()
+		sort.Strings(members)
+		// GetN returns every member once if asked for more
+		got, err := c.GetN("loda__cpu__1", 10)
+		if err != nil {
+			t.Fatalf("%s: get n failed: %s", tt.name, err)
+		}
+		sort.Strings(got)
+		if len(got) != len(tt.want) || len(members) != len(tt.want) {
+			t.Errorf("%s: got members %v and get n %v, want %v", tt.name, members, got, tt.want)
+			continue
+		}
+		for i := range tt.want {
+			if got[i] != tt.want[i] || members[i] != tt.want[i] {
+				t.Errorf("%s: got members %v and get n %v, want %v", tt.name, members, got, tt.want)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package adapter
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/influxdata/kapacitor/client/v1"
+	"github.com/lodastack/log"
+)
+
+// Drain moves the tasks off the node before its maintenance. The node is
+// removed from the ring until Undrain, then every task on it is copied to
+// its new owner before deleted from the node, so the alarms keep running.
+func (k *Kapacitor) Drain(addr string) error {
+	return k.DrainContext(context.Background(), addr)
+}
+
+func (k *Kapacitor) DrainContext(ctx context.Context, addr string) error {
+	url := k.fullAddr(addr)
+	k.mu.Lock()
+	c, ok := k.Clients[url]
+	if !ok {
+		k.mu.Unlock()
+		return fmt.Errorf("kapacitor %s not found", url)
+	}
+	// the tasks need another node to move to, draining again retries
+	// the tasks left on the node
+	inRing := !k.unhealthy[url] && !k.drained[url]
+	if inRing && len(k.Hash.Members()) == 1 {
+		k.mu.Unlock()
+		return fmt.Errorf("can't drain the last kapacitor node %s", url)
+	}
+	if k.drained == nil {
+		k.drained = make(map[string]bool)
+	}
+	k.drained[url] = true
+	if inRing {
+		k.Hash.Remove(url)
+	}
+	k.mu.Unlock()
+	log.Infof("drain kapacitor node=%s", url)
+
+	var listOpts client.ListTasksOptions
+	listOpts.Default()
+	listOpts.Limit = -1
+	listOpts.ScriptFormat = "raw"
+	var tasks []client.Task
+	err := callContext(ctx, func() error {
+		var err error
+		tasks, err = c.ListTasks(&listOpts)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("list kapacitor %s tasks failed: %s", url, err)
+	}
+
+	var errs []error
+	for _, task := range tasks {
+		if !k.owns(task.ID) {
+			continue
+		}
+		if err := k.drainTask(ctx, c, url, task); err != nil {
+			log.Errorf("drain task failed %s: %s", taskFields(task.ID, url), err)
+			errs = append(errs, err)
+		}
+	}
+	return joinErrors(errs)
+}
+
+// drainTask copies the task to its owner and deletes it from the draining node.
+func (k *Kapacitor) drainTask(ctx context.Context, c Client, url string, task client.Task) error {
+	owner, err := k.hashKapacitor(task.ID)
+	if err != nil {
+		return err
+	}
+	k.mu.RLock()
+	oc, ok := k.Clients[owner]
+	k.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("get cache kapacitor %s client failed", owner)
+	}
+	log.Infof("move task %s owner=%s", taskFields(task.ID, url), owner)
+	err = callContext(ctx, func() error {
+		_, err := oc.CreateTask(client.CreateTaskOptions{
+			ID:         task.ID,
+			TemplateID: task.TemplateID,
+			Type:       task.Type,
+			DBRPs:      task.DBRPs,
+			TICKscript: k.withNode(task.TICKscript, owner),
+			Status:     task.Status,
+			Vars:       task.Vars,
+		})
+		return err
+	})
+	if err != nil && !taskExists(err) {
+		return fmt.Errorf("create task %s at %s failed: %s", task.ID, owner, err)
+	}
+	err = callContext(ctx, func() error {
+		return c.DeleteTask(c.TaskLink(task.ID))
+	})
+	if err != nil && !taskNotExist(err) {
+		return fmt.Errorf("delete task %s at %s failed: %s", task.ID, url, err)
+	}
+	return nil
+}
+
+// Undrain puts the drained node back to the ring, the tasks hashed to
+// it are moved back by the next Work.
+func (k *Kapacitor) Undrain(addr string) error {
+	url := k.fullAddr(addr)
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if !k.drained[url] {
+		return fmt.Errorf("kapacitor %s is not drained", url)
+	}
+	delete(k.drained, url)
+	if !k.unhealthy[url] {
+		k.Hash.AddWithWeight(url, k.weights[url])
+	}
+	log.Infof("undrain kapacitor node=%s", url)
+	return nil
+}
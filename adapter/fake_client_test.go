@@ -0,0 +1,228 @@
+package adapter
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/influxdata/kapacitor/client/v1"
+	"github.com/lodastack/models"
+)
+
+const tasksPath = "/kapacitor/v1/tasks/"
+
+// fakeClient is a kapacitor node keeping the tasks in memory,
+// it records the calls for the tests to check.
+type fakeClient struct {
+	mu    sync.Mutex
+	tasks map[string]client.Task
+
+	// errors returned instead of doing the call
+	pingErr   error
+	listErr   error
+	createErr error
+	updateErr error
+	deleteErr error
+
+	creates  []client.CreateTaskOptions
+	updates  map[string][]client.UpdateTaskOptions
+	deletes  map[string]int
+	handlers []client.TopicHandlerOptions
+}
+
+var _ Client = (*fakeClient)(nil)
+
+func newFakeClient() *fakeClient {
+	return &fakeClient{
+		tasks:   make(map[string]client.Task),
+		updates: make(map[string][]client.UpdateTaskOptions),
+		deletes: make(map[string]int),
+	}
+}
+
+func (f *fakeClient) Ping() (time.Duration, string, error) {
+	return 0, "", f.pingErr
+}
+
+func (f *fakeClient) TaskLink(id string) client.Link {
+	return client.Link{Href: tasksPath + id}
+}
+
+func linkID(link client.Link) string {
+	return strings.TrimPrefix(link.Href, tasksPath)
+}
+
+func (f *fakeClient) Task(link client.Link, opt *client.TaskOptions) (client.Task, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	task, ok := f.tasks[linkID(link)]
+	if !ok {
+		return client.Task{}, errors.New("no task exists")
+	}
+	return task, nil
+}
+
+func (f *fakeClient) ListTasks(opt *client.ListTasksOptions) ([]client.Task, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.listErr != nil {
+		return nil, f.listErr
+	}
+	ids := make([]string, 0, len(f.tasks))
+	for id := range f.tasks {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	tasks := make([]client.Task, 0, len(ids))
+	for _, id := range ids {
+		tasks = append(tasks, f.tasks[id])
+	}
+	return tasks, nil
+}
+
+func (f *fakeClient) CreateTask(opt client.CreateTaskOptions) (client.Task, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.creates = append(f.creates, opt)
+	if f.createErr != nil {
+		return client.Task{}, f.createErr
+	}
+	if _, ok := f.tasks[opt.ID]; ok {
+		return client.Task{}, errors.New("task already exists")
+	}
+	task := client.Task{
+		Link:       f.TaskLink(opt.ID),
+		ID:         opt.ID,
+		TemplateID: opt.TemplateID,
+		Type:       opt.Type,
+		DBRPs:      opt.DBRPs,
+		TICKscript: opt.TICKscript,
+		Vars:       opt.Vars,
+		Status:     opt.Status,
+	}
+	f.tasks[opt.ID] = task
+	return task, nil
+}
+
+// UpdateTask sets the non-zero options like the kapacitor PATCH does.
+func (f *fakeClient) UpdateTask(link client.Link, opt client.UpdateTaskOptions) (client.Task, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := linkID(link)
+	f.updates[id] = append(f.updates[id], opt)
+	if f.updateErr != nil {
+		return client.Task{}, f.updateErr
+	}
+	task, ok := f.tasks[id]
+	if !ok {
+		return client.Task{}, errors.New("no task exists")
+	}
+	if opt.TemplateID != "" {
+		task.TemplateID = opt.TemplateID
+	}
+	if opt.Type != 0 {
+		task.Type = opt.Type
+	}
+	if opt.DBRPs != nil {
+		task.DBRPs = opt.DBRPs
+	}
+	if opt.TICKscript != "" {
+		task.TICKscript = opt.TICKscript
+	}
+	if opt.Status != 0 {
+		task.Status = opt.Status
+	}
+	if opt.Vars != nil {
+		task.Vars = opt.Vars
+	}
+	f.tasks[id] = task
+	return task, nil
+}
+
+func (f *fakeClient) DeleteTask(link client.Link) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := linkID(link)
+	f.deletes[id]++
+	if f.deleteErr != nil {
+		return f.deleteErr
+	}
+	if _, ok := f.tasks[id]; !ok {
+		return errors.New("no task exists")
+	}
+	delete(f.tasks, id)
+	return nil
+}
+
+func (f *fakeClient) TopicHandlersLink(topic string) client.Link {
+	return client.Link{Href: "/kapacitor/v1/alerts/topics/" + topic + "/handlers"}
+}
+
+func (f *fakeClient) TopicHandlerLink(topic, id string) client.Link {
+	return client.Link{Href: "/kapacitor/v1/alerts/topics/" + topic + "/handlers/" + id}
+}
+
+func (f *fakeClient) CreateTopicHandler(link client.Link, opt client.TopicHandlerOptions) (client.TopicHandler, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.handlers = append(f.handlers, opt)
+	return client.TopicHandler{ID: opt.ID, Kind: opt.Kind}, nil
+}
+
+func (f *fakeClient) ReplaceTopicHandler(link client.Link, opt client.TopicHandlerOptions) (client.TopicHandler, error) {
+	return f.CreateTopicHandler(link, opt)
+}
+
+// put adds the task to the node as if it was created before.
+func (f *fakeClient) put(task client.Task) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	task.Link = f.TaskLink(task.ID)
+	f.tasks[task.ID] = task
+}
+
+func (f *fakeClient) has(id string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.tasks[id]
+	return ok
+}
+
+// newTestKapacitor returns the adapter of the nodes talking to fake clients
+// keyed by the full address.
+func newTestKapacitor(t *testing.T, opts Options, addrs ...string) (*Kapacitor, map[string]*fakeClient) {
+	fakes := make(map[string]*fakeClient)
+	k, err := NewKapacitorWithOptions(addrs, "http://event", opts)
+	if err != nil {
+		t.Fatalf("new kapacitor failed: %s", err)
+	}
+	k.mu.Lock()
+	for url := range k.Clients {
+		f := newFakeClient()
+		fakes[url] = f
+		k.Clients[url] = f
+	}
+	k.mu.Unlock()
+	return k, fakes
+}
+
+// testAlarm returns a valid threshold alarm of the version.
+func testAlarm(version string) Alarm {
+	var alarm Alarm
+	alarm.Version = version
+	alarm.DB = "loda.db"
+	alarm.RP = "loda"
+	alarm.Measurement = "cpu.idle"
+	alarm.Trigger = models.ThresHold
+	alarm.Func = "mean"
+	alarm.Expression = "<"
+	alarm.Value = "10"
+	alarm.Period = "5m"
+	alarm.Every = "1m"
+	alarm.GroupBy = "host"
+	alarm.Enable = "true"
+	return alarm
+}
@@ -0,0 +1,77 @@
+package adapter
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/lodastack/log"
+)
+
+// default interval of pinging kapacitor nodes
+const defaultHealthCheckInterval = 30 * time.Second
+
+// HealthCheck pings every kapacitor node each interval until Close, a node
+// failing the ping is removed from the hash ring until it recovers, so the
+// alarms hashed to it are created on the other nodes by the next Work.
+func (k *Kapacitor) HealthCheck(interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultHealthCheckInterval
+	}
+	ticker := time.NewTicker(interval)
+	for {
+		select {
+		case <-ticker.C:
+			if !k.sleepJitter(context.Background()) {
+				ticker.Stop()
+				return
+			}
+			k.checkHealth()
+		case <-k.done:
+			ticker.Stop()
+			return
+		}
+	}
+}
+
+func (k *Kapacitor) checkHealth() {
+	k.mu.RLock()
+	clients := make(map[string]Client, len(k.Clients))
+	for url, c := range k.Clients {
+		clients[url] = c
+	}
+	k.mu.RUnlock()
+
+	for url, c := range clients {
+		_, _, err := c.Ping()
+
+		k.mu.Lock()
+		// the node may be removed by SetAddr during the ping
+		if _, ok := k.Clients[url]; ok {
+			if err != nil && !k.unhealthy[url] {
+				log.Errorf("kapacitor %s is unhealthy, remove it from the ring: %s", url, err)
+				k.unhealthy[url] = true
+				// a drained node is already out of the ring
+				if !k.drained[url] {
+					k.Hash.Remove(url)
+				}
+			} else if err == nil && k.unhealthy[url] {
+				log.Infof("kapacitor %s recovered, add it back to the ring", url)
+				delete(k.unhealthy, url)
+				if !k.drained[url] {
+					k.Hash.AddWithWeight(url, k.weights[url])
+				}
+			}
+		}
+		k.mu.Unlock()
+	}
+}
+
+// HealthyAddrs returns the sorted kapacitor nodes in the hash ring.
+func (k *Kapacitor) HealthyAddrs() []string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	addrs := k.Hash.Members()
+	sort.Strings(addrs)
+	return addrs
+}
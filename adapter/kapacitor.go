@@ -1,8 +1,12 @@
 package adapter
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
-	"strconv"
+	"io"
+	"net"
 	"strings"
 	"sync"
 	"time"
@@ -14,246 +18,1437 @@ import (
 )
 
 const root = "loda"
-const schemaURL = "http://%s:9092"
+const defaultPort = "9092"
+
+// ErrNoKapacitor is returned when there is no kapacitor node in the hash ring.
+var ErrNoKapacitor = errors.New("no kapacitor nodes available")
+
+// FailPolicy decides where a task goes if its hashed node is down.
+type FailPolicy int
+
+const (
+	// FailClosed fails the task change until the hashed node is back.
+	FailClosed FailPolicy = iota
+	// FailOpen creates the task on the next healthy node in the ring,
+	// so the alarm still runs somewhere.
+	FailOpen
+)
+
+// RemovePolicy decides the nodes RemoveTask deletes the task from.
+type RemovePolicy int
+
+const (
+	// RemoveAll deletes the task from every node, it's safe in ring
+	// transitions when the task may be left on a former owner.
+	RemoveAll RemovePolicy = iota
+	// RemoveOwner only deletes the task from the hashed node and the nodes
+	// the last Tasks found it on, for a stable ring.
+	RemoveOwner
+)
+
+// default kapacitor client timeout
+const defaultTimeout = 3 * time.Second
+
+// default User-Agent of the kapacitor requests
+const defaultUserAgent = "loda-alarm-adapter"
+
+// default max number of concurrent task changes in Work
+const defaultMaxConcurrency = 16
+
+// default number of concurrent creates per node in CreateTasks
+const defaultNodeConcurrency = 4
 
 type Kapacitor struct {
 	Addrs     []string
 	EventAddr string
+	Timeout   time.Duration
+	// use https if not nil
+	TLSConfig *tls.Config
+	// no authentication if nil
+	Credentials *client.Credentials
+	// User-Agent of the requests to kapacitor, the client's default if empty
+	UserAgent string
+	// max number of concurrent task changes in Work
+	MaxConcurrency int
+	sem            chan struct{}
+	// number of concurrent creates per node in CreateTasks,
+	// and concurrent deletes per node
+	NodeConcurrency int
+	nodeSemmu       sync.Mutex
+	nodeSem         map[string]chan struct{}
+	// retry transient failures of CreateTask
+	MaxAttempts int
+	RetryDelay  time.Duration
 
 	mu      sync.RWMutex
-	Clients map[string]*client.Client
+	Clients map[string]Client
+	// creates the client of a new node, nil for the kapacitor client
+	NewClient func(config client.Config) (Client, error)
 
 	Hash *Consistent
+	// nodes failed the health check, they are not in the ring
+	unhealthy map[string]bool
+	// nodes in maintenance, they are not in the ring until Undrain
+	drained map[string]bool
+	// weight of the nodes in the ring, keyed by address or full address
+	Weights map[string]int
+	weights map[string]int
+	// number of virtual nodes per node in the ring
+	Replicas int
+
+	// namespace prefix of the task IDs, RemoveTask only deletes the tasks
+	// under it so adapters with different roots can share a cluster
+	Root string
+	// timezone of the alarm STime and ETime, UTC if nil
+	Location *time.Location
+	// where the task goes if its hashed node is down
+	FailPolicy FailPolicy
+	// the nodes RemoveTask deletes the task from
+	RemovePolicy RemovePolicy
+	// timeout of posting the alerts to the event address, no timeout if 0
+	PostTimeout time.Duration
+	// log the response body of the failed posts in kapacitor
+	CaptureResponse bool
+	// set the alert id of the posts to "<version>:<group>"
+	GroupID bool
+	// max random delay of the periodic Run and HealthCheck passes
+	Jitter time.Duration
+	// publish the alerts to the topic handled by one post handler per node
+	// instead of a post per task, see EnsureTopicHandlers
+	Topic string
+	// key of the alarm in the hash ring, HashByVersion if nil
+	HashKey func(alarm Alarm) string
+	// fetch the task back after CreateTask to confirm it's created
+	VerifyCreate bool
+	// called with the task definition before RemoveTask deletes it, e.g. to
+	// keep it for RestoreTask, the task is not deleted if it returns an error
+	BeforeRemove func(task client.Task) error
+	// group by time window offset of the alarms without their own, for the
+	// write latency, default 5s
+	Offset string
+	// the alerts are posted to it as well as EventAddr if set, kapacitor
+	// has no failover between the handlers
+	FallbackEventAddr string
+	// tag the alerts with the node of the task by the X-Kapacitor-Node
+	// header of the posts
+	NodeHeader bool
+	// delay the evaluation of the aligned alarms by a few seconds derived
+	// from the task ID, so the queries of a node don't fire all at once
+	Stagger bool
+	// environment of the alarms sharing the cluster with other ones, e.g.
+	// "staging", it's posted as the env query and suffixes the Topic.
+	// The adapters of the environments need their own Root, the alarms
+	// are pulled from the registry namespace of the Root.
+	Environment string
+	// hash keys of the task IDs seen
+	hashKeys map[string]string
+
+	// nodes and runtime errors of the tasks found by the last Tasks
+	taskNodes  map[string][]string
+	taskErrors map[string]error
+
+	// create failures of the versions backed off by Work
+	backoffmu   sync.Mutex
+	createFails map[string]*StuckAlarm
+
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// in-flight passes of task changes waited by Shutdown
+	inflightmu sync.Mutex
+	inflight   sync.WaitGroup
+	closing    bool
+
+	statsmu sync.Mutex
+	stats   Stats
+}
+
+// Options is the optional settings of Kapacitor,
+// zero value fields fall back to the defaults.
+type Options struct {
+	// kapacitor client timeout, default 3s
+	Timeout time.Duration
+
+	// talk to kapacitor over https
+	TLS                bool
+	InsecureSkipVerify bool
+	// path of the PEM encoded CA certificate, system pool is used if empty
+	CACert string
+	// path of the PEM encoded client certificate and key for mutual TLS
+	Cert string
+	Key  string
+
+	// basic auth, or bearer auth if Token is set
+	Username string
+	Password string
+	Token    string
+
+	// User-Agent of the requests, tells the adapter in the kapacitor
+	// access logs, default "loda-alarm-adapter"
+	UserAgent string
+
+	// max number of concurrent task changes in Work, default 16
+	MaxConcurrency int
+	// number of concurrent creates per node in CreateTasks,
+	// and concurrent deletes per node, default 4
+	NodeConcurrency int
+
+	// max attempts of CreateTask on transient errors, default 3,
+	// the delay starts at RetryDelay (default 500ms) and doubles every retry
+	MaxAttempts int
+	RetryDelay  time.Duration
+
+	// weight of the nodes in the hash ring, default 1,
+	// keyed by the address or the full address with schema and port
+	Weights map[string]int
+	// number of virtual nodes per node in the hash ring, default 20
+	Replicas int
+
+	// namespace prefix of the task IDs, default "loda"
+	Root string
+
+	// IANA timezone of the alarm STime and ETime, e.g. "Asia/Shanghai", default UTC
+	Timezone string
+
+	// where the task goes if its hashed node is down, default FailClosed
+	FailPolicy FailPolicy
+
+	// the nodes RemoveTask deletes the task from, default RemoveAll
+	RemovePolicy RemovePolicy
+
+	// timeout of posting the alerts to the event address, no timeout if 0
+	PostTimeout time.Duration
+	// log the response body of the failed posts in kapacitor
+	CaptureResponse bool
+	// set the alert id of the posts to "<version>:<group>", the group is the
+	// tags like "host=a,region=b", for the receiver to tell the series
+	GroupID bool
+
+	// max random delay of the periodic Run and HealthCheck passes, no delay if 0
+	Jitter time.Duration
+
+	// publish the alerts to the topic instead of a post per task, e.g. "loda"
+	Topic string
+
+	// key of the alarm in the hash ring, default HashByVersion
+	HashKey func(alarm Alarm) string
+
+	// fetch the task back after CreateTask to confirm it's created,
+	// it doubles the requests of the creates
+	VerifyCreate bool
+
+	// group by time window offset of the alarms without their own, default 5s
+	Offset string
+
+	// the backup event server posted together with eventAddr
+	FallbackEventAddr string
+
+	// post the alerts with the X-Kapacitor-Node header
+	NodeHeader bool
+
+	// spread the evaluation of the aligned alarms in a minute
+	Stagger bool
+
+	// environment of the alarms, letters, digits, "_", "." or "-"
+	Environment string
 }
 
-func NewKapacitor(addrs []string, eventAddr string) *Kapacitor {
+func NewKapacitor(addrs []string, eventAddr string) (*Kapacitor, error) {
+	return NewKapacitorWithOptions(addrs, eventAddr, Options{})
+}
+
+func NewKapacitorWithOptions(addrs []string, eventAddr string, opts Options) (*Kapacitor, error) {
 	k := &Kapacitor{
-		EventAddr: eventAddr,
+		EventAddr:         eventAddr,
+		Timeout:           opts.Timeout,
+		UserAgent:         opts.UserAgent,
+		MaxConcurrency:    opts.MaxConcurrency,
+		NodeConcurrency:   opts.NodeConcurrency,
+		MaxAttempts:       opts.MaxAttempts,
+		RetryDelay:        opts.RetryDelay,
+		Weights:           opts.Weights,
+		Replicas:          opts.Replicas,
+		Root:              opts.Root,
+		FailPolicy:        opts.FailPolicy,
+		RemovePolicy:      opts.RemovePolicy,
+		PostTimeout:       opts.PostTimeout,
+		CaptureResponse:   opts.CaptureResponse,
+		GroupID:           opts.GroupID,
+		Jitter:            opts.Jitter,
+		Topic:             opts.Topic,
+		HashKey:           opts.HashKey,
+		VerifyCreate:      opts.VerifyCreate,
+		Offset:            opts.Offset,
+		FallbackEventAddr: opts.FallbackEventAddr,
+		NodeHeader:        opts.NodeHeader,
+		Stagger:           opts.Stagger,
+		Environment:       opts.Environment,
+		done:              make(chan struct{}),
+	}
+	if k.Timeout <= 0 {
+		k.Timeout = defaultTimeout
+	}
+	if k.UserAgent == "" {
+		k.UserAgent = defaultUserAgent
+	}
+	if k.Root == "" {
+		k.Root = root
+	}
+	if k.MaxConcurrency <= 0 {
+		k.MaxConcurrency = defaultMaxConcurrency
+	}
+	k.sem = make(chan struct{}, k.MaxConcurrency)
+	if k.NodeConcurrency <= 0 {
+		k.NodeConcurrency = defaultNodeConcurrency
+	}
+	if k.MaxAttempts <= 0 {
+		k.MaxAttempts = defaultMaxAttempts
+	}
+	if k.RetryDelay <= 0 {
+		k.RetryDelay = defaultRetryDelay
+	}
+	if opts.TLS {
+		tlsConfig, err := newTLSConfig(opts)
+		if err != nil {
+			return nil, fmt.Errorf("load kapacitor tls config failed: %s", err)
+		}
+		k.TLSConfig = tlsConfig
+	}
+	if k.Offset != "" {
+		if _, err := parseDuration(k.Offset); err != nil {
+			return nil, fmt.Errorf("invalid offset: %s", err)
+		}
+	}
+	// the environment goes into the post urls and the topic name
+	if k.Environment != "" && !fieldReg.MatchString(k.Environment) {
+		return nil, fmt.Errorf("invalid environment %q", k.Environment)
 	}
-	k.SetAddr(addrs)
-	return k
+	if opts.Timezone != "" {
+		loc, err := time.LoadLocation(opts.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("load timezone %s failed: %s", opts.Timezone, err)
+		}
+		k.Location = loc
+	}
+	if opts.Token != "" {
+		k.Credentials = &client.Credentials{
+			Method: client.BearerAuthentication,
+			Token:  opts.Token,
+		}
+	} else if opts.Username != "" {
+		k.Credentials = &client.Credentials{
+			Method:   client.UserAuthentication,
+			Username: opts.Username,
+			Password: opts.Password,
+		}
+	}
+	if err := k.SetAddr(addrs); err != nil {
+		return nil, err
+	}
+	return k, nil
 }
 
-func (k *Kapacitor) SetAddr(addrs []string) {
+// SetAddr replaces the kapacitor nodes, the old nodes are kept
+// if none of the addrs gets a usable client. It's a no-op if the nodes
+// are not changed, so a flapping discovery doesn't rebuild the ring.
+func (k *Kapacitor) SetAddr(addrs []string) error {
 	k.mu.Lock()
 	defer k.mu.Unlock()
+	if k.Hash != nil && k.sameAddrs(addrs) {
+		log.Debugf("kapacitor nodes not changed: %v", k.Addrs)
+		return nil
+	}
 	log.Infof("start update old clients: %v", k.Addrs)
-	c := NewConsistent()
-	clients := make(map[string]*client.Client)
+	hash := NewConsistentWithReplicas(k.Replicas)
+	clients := make(map[string]Client)
+	weights := make(map[string]int)
 	var fullAddrs []string
-	for _, addr := range addrs {
-		addr = fmt.Sprintf(schemaURL, addr)
-		c.Add(addr)
+	for _, raw := range addrs {
+		addr := k.fullAddr(raw)
+		weight := k.nodeWeight(raw, addr)
 
-		config := client.Config{
-			URL:     addr,
-			Timeout: time.Duration(3) * time.Second,
-		}
-		c, err := client.New(config)
-		if err != nil {
-			log.Errorf("new kapacitor %s client failed: %s", addr, err)
-			continue
+		// keep the client of an unchanged node
+		c, ok := k.Clients[addr]
+		if !ok {
+			var err error
+			c, err = k.nodeClient(addr)
+			if err != nil {
+				log.Errorf("new kapacitor client failed node=%s: %s", addr, err)
+				continue
+			}
 		}
 		clients[addr] = c
 		fullAddrs = append(fullAddrs, addr)
+		hash.AddWithWeight(addr, weight)
+		weights[addr] = weight
 	}
+	if len(clients) == 0 {
+		return fmt.Errorf("no usable kapacitor client in %v", addrs)
+	}
+	// keep the unhealthy and drained nodes out of the new ring
+	unhealthy := make(map[string]bool)
+	drained := make(map[string]bool)
+	for _, addr := range fullAddrs {
+		if k.unhealthy[addr] {
+			unhealthy[addr] = true
+		}
+		if k.drained[addr] {
+			drained[addr] = true
+		}
+		if unhealthy[addr] || drained[addr] {
+			hash.Remove(addr)
+		}
+	}
+	k.unhealthy = unhealthy
+	k.drained = drained
+	k.weights = weights
 	k.Addrs = fullAddrs
+	for url, c := range k.Clients {
+		if _, ok := clients[url]; !ok {
+			closeClient(url, c)
+		}
+	}
 	k.Clients = clients
-	k.Hash = c
+	k.Hash = hash
 	log.Infof("start update clients: %v", k.Addrs)
+	return nil
+}
+
+// AddNode adds the kapacitor node without touching the other clients, only
+// the keys hashed to it move. It's a no-op if the node is there, the next
+// SetAddr still replaces the nodes with the discovered ones.
+func (k *Kapacitor) AddNode(addr string) error {
+	url := k.fullAddr(addr)
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, ok := k.Clients[url]; ok {
+		return nil
+	}
+	c, err := k.nodeClient(url)
+	if err != nil {
+		log.Errorf("new kapacitor client failed node=%s: %s", url, err)
+		return err
+	}
+	if k.Hash == nil {
+		k.Hash = NewConsistentWithReplicas(k.Replicas)
+	}
+	if k.Clients == nil {
+		k.Clients = make(map[string]Client)
+	}
+	if k.weights == nil {
+		k.weights = make(map[string]int)
+	}
+	weight := k.nodeWeight(addr, url)
+	k.Clients[url] = c
+	k.weights[url] = weight
+	k.Addrs = append(k.Addrs, url)
+	k.Hash.AddWithWeight(url, weight)
+	log.Infof("add kapacitor node=%s weight=%d", url, weight)
+	return nil
+}
+
+// RemoveNode takes the kapacitor node out and closes its client, only the
+// keys hashed to it move, the next Work moves its tasks if it's still up.
+// The last node is kept like SetAddr does.
+func (k *Kapacitor) RemoveNode(addr string) error {
+	url := k.fullAddr(addr)
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	c, ok := k.Clients[url]
+	if !ok {
+		return fmt.Errorf("kapacitor node %s not found", url)
+	}
+	if len(k.Clients) == 1 {
+		return fmt.Errorf("can't remove the last kapacitor node %s", url)
+	}
+	// the unhealthy and drained nodes are not in the ring
+	if !k.unhealthy[url] && !k.drained[url] {
+		k.Hash.Remove(url)
+	}
+	delete(k.unhealthy, url)
+	delete(k.drained, url)
+	delete(k.weights, url)
+	delete(k.Clients, url)
+	addrs := make([]string, 0, len(k.Addrs))
+	for _, a := range k.Addrs {
+		if a != url {
+			addrs = append(addrs, a)
+		}
+	}
+	k.Addrs = addrs
+	closeClient(url, c)
+	log.Infof("remove kapacitor node=%s", url)
+	return nil
+}
+
+// nodeClient creates the client of the node at the full address.
+// There is no gzip option for the request bodies, the client config has no
+// transport setting and the kapacitor task API doesn't decode them, the
+// responses are already gzipped as the Go transport asks for it.
+func (k *Kapacitor) nodeClient(addr string) (Client, error) {
+	return k.newClient(client.Config{
+		URL:         addr,
+		Timeout:     k.Timeout,
+		UserAgent:   k.UserAgent,
+		TLSConfig:   k.TLSConfig,
+		Credentials: k.Credentials,
+	})
+}
+
+// nodeWeight returns the weight of the node keyed by its full or raw address.
+func (k *Kapacitor) nodeWeight(raw, addr string) int {
+	if weight, ok := k.Weights[addr]; ok {
+		return weight
+	}
+	return k.Weights[raw]
+}
+
+// sameAddrs reports whether addrs is the current node set in any order.
+func (k *Kapacitor) sameAddrs(addrs []string) bool {
+	current := make(map[string]bool, len(k.Addrs))
+	for _, addr := range k.Addrs {
+		current[addr] = true
+	}
+	next := make(map[string]bool, len(addrs))
+	for _, raw := range addrs {
+		next[k.fullAddr(raw)] = true
+	}
+	if len(next) != len(current) {
+		return false
+	}
+	for addr := range next {
+		if !current[addr] {
+			return false
+		}
+	}
+	return true
+}
+
+// Close stops the health check and drops the kapacitor clients. The
+// kapacitor client has no Close nor exposes its transport, its idle
+// connections are left to the nodes to close.
+func (k *Kapacitor) Close() {
+	k.closeOnce.Do(func() { close(k.done) })
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for url, c := range k.Clients {
+		closeClient(url, c)
+	}
+	k.Clients = make(map[string]Client)
+}
+
+// closeClient closes the client if it's an io.Closer, e.g. a wrapper given
+// by NewClient, the kapacitor client isn't one.
+func closeClient(url string, c Client) {
+	closer, ok := c.(io.Closer)
+	if !ok {
+		return
+	}
+	if err := closer.Close(); err != nil {
+		log.Errorf("close kapacitor client failed node=%s: %s", url, err)
+	}
+}
+
+// fullAddr completes the addr with the default schema and port,
+// addr already has a schema or port is kept as it is.
+func (k *Kapacitor) fullAddr(addr string) string {
+	if strings.Contains(addr, "://") {
+		return addr
+	}
+	schema := "http"
+	if k.TLSConfig != nil {
+		schema = "https"
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, defaultPort)
+	}
+	return schema + "://" + addr
 }
 
 func (k *Kapacitor) Tasks() map[string]client.Task {
+	return k.TasksContext(context.Background())
+}
+
+// TasksContext lists the tasks of all nodes under Root, the other tasks
+// are not managed by the adapter. The nodes not listed before ctx is done
+// are skipped.
+func (k *Kapacitor) TasksContext(ctx context.Context) map[string]client.Task {
 	tasks := make(map[string]client.Task)
-	for _, url := range k.Addrs {
+	taskNodes := make(map[string][]string)
+	taskErrors := make(map[string]error)
+	for _, node := range k.listNodeTasks(ctx) {
+		for _, t := range node.tasks {
+			if !k.owns(t.ID) {
+				continue
+			}
+			if t.Error != "" {
+				taskErrors[t.ID] = fmt.Errorf("task at %s failed: %s", node.url, t.Error)
+			}
+			if nodes, ok := taskNodes[t.ID]; ok {
+				log.Warningf("duplicate task %s also_at=%s", taskFields(t.ID, node.url), strings.Join(nodes, ","))
+			}
+			tasks[t.ID] = t
+			taskNodes[t.ID] = append(taskNodes[t.ID], node.url)
+		}
+	}
+	k.mu.Lock()
+	k.taskNodes = taskNodes
+	k.taskErrors = taskErrors
+	k.mu.Unlock()
+	return tasks
+}
+
+type nodeTasks struct {
+	url   string
+	tasks []client.Task
+}
+
+// listNodeTasks lists the tasks of every node concurrently, the result is in
+// the order of Addrs, the nodes failed or not listed before ctx is done are skipped.
+func (k *Kapacitor) listNodeTasks(ctx context.Context) []nodeTasks {
+	k.mu.RLock()
+	addrs := append([]string(nil), k.Addrs...)
+	k.mu.RUnlock()
+
+	nodes := make([]*nodeTasks, len(addrs))
+	var wg sync.WaitGroup
+	for i, url := range addrs {
 		k.mu.RLock()
 		c, ok := k.Clients[url]
 		k.mu.RUnlock()
 		if !ok {
-			log.Errorf("get cache kapacitor %s client failed", url)
+			log.Errorf("get cache kapacitor client failed node=%s", url)
+			continue
+		}
+		wg.Add(1)
+		go func(i int, url string, c Client) {
+			defer wg.Done()
+			var listOpts client.ListTasksOptions
+			listOpts.Default()
+			listOpts.Limit = -1
+			// compare with the script as it was submitted
+			listOpts.ScriptFormat = "raw"
+			var ts []client.Task
+			err := callContext(ctx, func() error {
+				var err error
+				ts, err = c.ListTasks(&listOpts)
+				return err
+			})
+			if err != nil {
+				log.Errorf("list kapacitor tasks failed node=%s: %s", url, err)
+				return
+			}
+			nodes[i] = &nodeTasks{url: url, tasks: ts}
+		}(i, url, c)
+	}
+	wg.Wait()
+
+	var res []nodeTasks
+	for _, node := range nodes {
+		if node != nil {
+			res = append(res, *node)
+		}
+	}
+	return res
+}
+
+// Duplicates returns the tasks found on more than one node by the last Tasks,
+// keyed by the task ID.
+func (k *Kapacitor) Duplicates() map[string][]string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	dups := make(map[string][]string)
+	for id, nodes := range k.taskNodes {
+		if len(nodes) > 1 {
+			dups[id] = append([]string(nil), nodes...)
+		}
+	}
+	return dups
+}
+
+// TaskErrors returns the runtime errors of the managed tasks found by
+// the last Tasks keyed by the task ID, e.g. a bad field type
+// kapacitor only finds after the task is created.
+func (k *Kapacitor) TaskErrors() map[string]error {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	errs := make(map[string]error, len(k.taskErrors))
+	for version, err := range k.taskErrors {
+		errs[version] = err
+	}
+	return errs
+}
+
+// nodesOf returns the nodes the task was found on by the last Tasks.
+func (k *Kapacitor) nodesOf(id string) []string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.taskNodes[id]
+}
+
+// Work syncs the alarms to kapacitor tasks listed by a fresh Tasks,
+// it waits all the changes done and returns the joined errors.
+func (k *Kapacitor) Work(tasks map[string]client.Task, alarms map[string]Alarm) error {
+	return k.WorkContext(context.Background(), tasks, alarms)
+}
+
+// WorkContext is Work with ctx passed to every task change,
+// the changes not started before ctx is done are given up.
+func (k *Kapacitor) WorkContext(ctx context.Context, tasks map[string]client.Task, alarms map[string]Alarm) error {
+	if !k.begin() {
+		return ErrShutdown
+	}
+	defer k.end()
+	plan := k.Plan(tasks, alarms)
+	var wg sync.WaitGroup
+	var errmu sync.Mutex
+	errs := plan.Errors
+	do := func(f func() error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var err error
+			select {
+			case k.sem <- struct{}{}:
+				defer func() { <-k.sem }()
+				err = f()
+			case <-ctx.Done():
+				err = ctx.Err()
+			}
+			if err != nil {
+				errmu.Lock()
+				errs = append(errs, err)
+				errmu.Unlock()
+			}
+		}()
+	}
+
+	// a failing version is not retried on every pass
+	k.pruneBackoff(alarms)
+	var skipped bool
+	for _, alarm := range plan.Create {
+		alarm := alarm
+		if k.backedOff(alarm) {
+			skipped = true
 			continue
 		}
-		var listOpts client.ListTasksOptions
-		listOpts.Default()
-		listOpts.Limit = -1
-		ts, err := c.ListTasks(&listOpts)
+		do(func() error {
+			_, err := k.CreateTaskContext(ctx, alarm)
+			switch {
+			case err == nil:
+				k.createDone(alarm)
+			// the node failures are not the alarm's fault
+			case ctx.Err() == nil && err != ErrNoKapacitor && !retryable(err):
+				k.createFailed(alarm, err)
+			}
+			return err
+		})
+	}
+	for _, move := range plan.Move {
+		move := move
+		do(func() error { return k.moveTask(ctx, move.Alarm, move.From) })
+	}
+	for id, strays := range plan.Strays {
+		id, strays := id, strays
+		do(func() error { return k.removeTaskAt(ctx, strays, id) })
+	}
+	for _, alarm := range plan.Update {
+		alarm := alarm
+		do(func() error { return k.UpdateTaskContext(ctx, alarm) })
+	}
+	for _, alarm := range plan.UpdateVars {
+		alarm := alarm
+		do(func() error { return k.UpdateVarsContext(ctx, alarm) })
+	}
+	for _, alarm := range plan.SetStatus {
+		alarm := alarm
+		do(func() error { return k.setTaskStatus(ctx, taskID(alarm), taskStatus(alarm)) })
+	}
+	for _, task := range plan.Remove {
+		task := task
+		do(func() error { return k.RemoveTaskContext(ctx, task) })
+	}
+	wg.Wait()
+	// the backed off creates are not reconciled yet
+	if len(errs) == 0 && !skipped {
+		k.count(func(s *Stats) { s.LastReconcile = time.Now() })
+	}
+	return joinErrors(errs)
+}
+
+// moveTask moves the task rehashed by a ring change from the old nodes to
+// its owner. The task is created before the old copies are deleted, so the
+// alarm keeps running, and the old copies are kept if the create fails.
+func (k *Kapacitor) moveTask(ctx context.Context, alarm Alarm, olds []string) error {
+	_, url, err := k.createTask(ctx, alarm)
+	if err != nil {
+		return err
+	}
+	// keep the copy at the next node if the owner was unreachable
+	var remove []string
+	for _, old := range olds {
+		if old != url {
+			remove = append(remove, old)
+		}
+	}
+	return k.removeTaskAt(ctx, remove, taskID(alarm))
+}
+
+// alarmFields formats the alarm context of a log line as key=value pairs,
+// so the logs can be filtered by version or node.
+func alarmFields(alarm Alarm, node string) string {
+	fields := fmt.Sprintf("version=%s node=%s db=%s rp=%s trigger=%s",
+		alarm.Version, node, alarm.DB, alarm.RP, alarm.Trigger)
+	if alarm.TaskID != "" {
+		fields += " task=" + alarm.TaskID
+	}
+	return fields
+}
+
+// taskFields is alarmFields of a task without the alarm.
+func taskFields(id, node string) string {
+	return fmt.Sprintf("version=%s node=%s", id, node)
+}
+
+// joinErrors joins errs into one error, nil if errs is empty.
+func joinErrors(errs []error) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	msgs := make([]string, 0, len(errs))
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	return fmt.Errorf("%d errors: %s", len(errs), strings.Join(msgs, "; "))
+}
+
+// callContext returns the result of f, or the ctx error if ctx is done first,
+// f keeps running in background until the client timeout in that case.
+func callContext(ctx context.Context, f func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() { done <- f() }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Create a new task and return it, e.g. to fetch the status by its Link.
+// It's a no-op if the task already exists, e.g. created by an overlapping Work,
+// only the ID and Link of the returned task are set in that case.
+func (k *Kapacitor) CreateTask(alarm Alarm) (client.Task, error) {
+	return k.CreateTaskContext(context.Background(), alarm)
+}
+
+func (k *Kapacitor) CreateTaskContext(ctx context.Context, alarm Alarm) (client.Task, error) {
+	task, _, err := k.createTask(ctx, alarm)
+	return task, err
+}
+
+// createTask creates the task and returns the node it's created at,
+// the next nodes in the ring are tried on unreachable nodes with FailOpen.
+func (k *Kapacitor) createTask(ctx context.Context, alarm Alarm) (_ client.Task, url string, err error) {
+	defer k.count(func(s *Stats) {
 		if err != nil {
-			log.Errorf("list kapacitor %s client failed: %s", url, err)
+			s.CreateFailures++
+		} else {
+			s.Created++
+		}
+	})
+	tick, err := k.genTick(alarm)
+	if err != nil {
+		log.Errorf("gen tick script failed %s: %s", alarmFields(alarm, ""), err)
+		return client.Task{}, "", err
+	}
+	createOpts := client.CreateTaskOptions{
+		ID:         taskID(alarm),
+		Type:       client.BatchTask,
+		DBRPs:      taskDBRPs(alarm),
+		TICKscript: tick,
+		Status:     taskStatus(alarm),
+		Vars:       taskVars(alarm),
+	}
+
+	k.setHashKey(alarm)
+	urls, err := k.candidates(createOpts.ID)
+	if err != nil {
+		log.Errorf("hash task failed %s: %s", alarmFields(alarm, ""), err)
+		return client.Task{}, "", err
+	}
+	for i, url := range urls {
+		k.mu.RLock()
+		c, ok := k.Clients[url]
+		k.mu.RUnlock()
+		if !ok {
+			log.Errorf("get cache kapacitor client failed %s", alarmFields(alarm, url))
+			err = fmt.Errorf("get cache kapacitor %s client failed", url)
 			continue
 		}
-		for _, t := range ts {
-			tasks[t.ID] = t
+		createOpts.TICKscript = k.withNode(tick, url)
+		log.Infof("create task %s", alarmFields(alarm, url))
+		// only read on success, a create given up by ctx may still write it
+		var task client.Task
+		err = k.retry(ctx, "create task "+alarm.Version, func() error {
+			return callContext(ctx, func() error {
+				var err error
+				task, err = c.CreateTask(createOpts)
+				return err
+			})
+		})
+		if err != nil && taskExists(err) {
+			log.Infof("task already exists %s", alarmFields(alarm, url))
+			return client.Task{ID: createOpts.ID, Link: c.TaskLink(createOpts.ID)}, url, nil
 		}
+		if err == nil && k.VerifyCreate {
+			err = verifyTask(ctx, c, createOpts)
+			if err != nil {
+				log.Errorf("verify task failed %s: %s", alarmFields(alarm, url), err)
+				return client.Task{}, url, err
+			}
+		}
+		if err == nil {
+			return task, url, nil
+		}
+		if _, ok := err.(net.Error); ok && i < len(urls)-1 {
+			log.Warningf("create task failed, try the next node %s: %s", alarmFields(alarm, url), err)
+			continue
+		}
+		log.Errorf("create task failed %s: %s", alarmFields(alarm, url), err)
+		return client.Task{}, url, err
 	}
-	return tasks
+	return client.Task{}, "", err
+}
+
+// verifyTask fetches the created task back to confirm it's there
+// with the status it's created with.
+func verifyTask(ctx context.Context, c Client, opts client.CreateTaskOptions) error {
+	var task client.Task
+	err := callContext(ctx, func() error {
+		var err error
+		task, err = c.Task(c.TaskLink(opts.ID), nil)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("get created task %s failed: %s", opts.ID, err)
+	}
+	if task.Status != opts.Status {
+		return fmt.Errorf("created task %s is %s, want %s", opts.ID, task.Status, opts.Status)
+	}
+	return nil
+}
+
+// CreateTasks creates the tasks of the alarms in bulk, e.g. on the first load,
+// the alarms are grouped by the hashed node and each node creates
+// NodeConcurrency tasks at a time. It returns the errors keyed by the alarm,
+// empty if all the tasks are created.
+func (k *Kapacitor) CreateTasks(alarms map[string]Alarm) map[string]error {
+	return k.CreateTasksContext(context.Background(), alarms)
 }
 
-func (k *Kapacitor) Work(tasks map[string]client.Task, alarms map[string]models.Alarm) {
+func (k *Kapacitor) CreateTasksContext(ctx context.Context, alarms map[string]Alarm) map[string]error {
+	var errmu sync.Mutex
+	errs := make(map[string]error)
+	if !k.begin() {
+		for id := range alarms {
+			errs[id] = ErrShutdown
+		}
+		return errs
+	}
+	defer k.end()
+	setErr := func(id string, err error) {
+		errmu.Lock()
+		errs[id] = err
+		errmu.Unlock()
+	}
+
+	groups := make(map[string]map[string]Alarm)
+	for _, alarm := range alarms {
+		k.setHashKey(alarm)
+	}
 	for id, alarm := range alarms {
-		if _, ok := tasks[id]; ok {
+		url, err := k.hashKapacitor(taskID(alarm))
+		if err != nil {
+			setErr(id, err)
 			continue
 		}
-		go k.CreateTask(alarm)
+		if groups[url] == nil {
+			groups[url] = make(map[string]Alarm)
+		}
+		groups[url][id] = alarm
 	}
 
-	for id, task := range tasks {
-		if _, ok := alarms[id]; ok {
-			continue
+	var wg sync.WaitGroup
+	for _, group := range groups {
+		ids := make(chan string)
+		for i := 0; i < k.NodeConcurrency && i < len(group); i++ {
+			wg.Add(1)
+			go func(group map[string]Alarm) {
+				defer wg.Done()
+				for id := range ids {
+					if _, err := k.CreateTaskContext(ctx, group[id]); err != nil {
+						setErr(id, err)
+					}
+				}
+			}(group)
 		}
-		go k.RemoveTask(task)
+		wg.Add(1)
+		go func(group map[string]Alarm) {
+			defer wg.Done()
+			defer close(ids)
+			for id := range group {
+				select {
+				case ids <- id:
+				case <-ctx.Done():
+					setErr(id, ctx.Err())
+				}
+			}
+		}(group)
 	}
+	wg.Wait()
+	return errs
+}
+
+// taskExists reports whether the create error means the task already exists.
+func taskExists(err error) bool {
+	return strings.Contains(err.Error(), "already exists")
+}
+
+// Update an existing task with the regenerated TICKscript.
+// Errors if the task does not exist.
+func (k *Kapacitor) UpdateTask(alarm Alarm) error {
+	return k.UpdateTaskContext(context.Background(), alarm)
 }
 
-// Create a new task.
-// Errors if the task already exists.
-func (k *Kapacitor) CreateTask(alarm models.Alarm) error {
+func (k *Kapacitor) UpdateTaskContext(ctx context.Context, alarm Alarm) (err error) {
+	defer k.count(func(s *Stats) {
+		if err != nil {
+			s.UpdateFailures++
+		} else {
+			s.Updated++
+		}
+	})
 	tick, err := k.genTick(alarm)
 	if err != nil {
-		log.Errorf("gen tick script failed:%s", err)
+		log.Errorf("gen tick script failed %s: %s", alarmFields(alarm, ""), err)
 		return err
 	}
-	dbrps := []client.DBRP{
-		{
-			Database:        alarm.DB,
-			RetentionPolicy: alarm.RP,
-		},
-	}
-	status := client.Disabled
-	if alarm.Enable == "true" {
-		status = client.Enabled
+	k.setHashKey(alarm)
+	url, err := k.hashKapacitor(taskID(alarm))
+	if err != nil {
+		log.Errorf("hash task failed %s: %s", alarmFields(alarm, ""), err)
+		return err
 	}
-
-	createOpts := client.CreateTaskOptions{
-		ID:         alarm.Version,
+	updateOpts := client.UpdateTaskOptions{
 		Type:       client.BatchTask,
-		DBRPs:      dbrps,
-		TICKscript: tick,
-		Status:     status,
+		DBRPs:      taskDBRPs(alarm),
+		TICKscript: k.withNode(tick, url),
+		Status:     taskStatus(alarm),
+		Vars:       taskVars(alarm),
+	}
+	k.mu.RLock()
+	c, ok := k.Clients[url]
+	k.mu.RUnlock()
+	if !ok {
+		log.Errorf("get cache kapacitor client failed %s", alarmFields(alarm, url))
+		return fmt.Errorf("get cache kapacitor %s client failed", url)
+	}
+	log.Infof("update task %s", alarmFields(alarm, url))
+	err = callContext(ctx, func() error {
+		_, err := c.UpdateTask(c.TaskLink(taskID(alarm)), updateOpts)
+		return err
+	})
+	if err != nil {
+		log.Errorf("update task failed %s: %s", alarmFields(alarm, url), err)
 	}
+	return err
+}
+
+// EnableTask starts the task without recreating it,
+// the id is the alarm version unless the alarm has its TaskID.
+func (k *Kapacitor) EnableTask(id string) error {
+	return k.setTaskStatus(context.Background(), id, client.Enabled)
+}
 
-	url := k.hashKapacitor(alarm.Version)
+// DisableTask stops the task, the task is kept on the node.
+func (k *Kapacitor) DisableTask(id string) error {
+	return k.setTaskStatus(context.Background(), id, client.Disabled)
+}
+
+func (k *Kapacitor) setTaskStatus(ctx context.Context, version string, status client.TaskStatus) (err error) {
+	defer k.count(func(s *Stats) {
+		if err != nil {
+			s.UpdateFailures++
+		} else {
+			s.Updated++
+		}
+	})
+	url, err := k.hashKapacitor(version)
+	if err != nil {
+		log.Errorf("hash task failed %s: %s", taskFields(version, ""), err)
+		return err
+	}
 	k.mu.RLock()
 	c, ok := k.Clients[url]
 	k.mu.RUnlock()
 	if !ok {
-		log.Errorf("get cache kapacitor %s client failed", url)
+		log.Errorf("get cache kapacitor client failed %s", taskFields(version, url))
 		return fmt.Errorf("get cache kapacitor %s client failed", url)
 	}
-	log.Infof("create task:%s at %s", alarm.Version, url)
-	_, err = c.CreateTask(createOpts)
+	log.Infof("set task %s status=%s", taskFields(version, url), status)
+	err = callContext(ctx, func() error {
+		_, err := c.UpdateTask(c.TaskLink(version), client.UpdateTaskOptions{Status: status})
+		return err
+	})
 	if err != nil {
-		log.Errorf("create task at %s failed:%s", url, err)
+		log.Errorf("set task status failed %s: %s", taskFields(version, url), err)
 	}
 	return err
 }
 
+func taskDBRPs(alarm Alarm) []client.DBRP {
+	dbrps := []client.DBRP{
+		{
+			Database:        alarm.DB,
+			RetentionPolicy: alarm.RP,
+		},
+	}
+	for _, d := range alarm.DBRPs {
+		dbrp := client.DBRP{
+			Database:        d.DB,
+			RetentionPolicy: d.RP,
+		}
+		exist := false
+		for _, v := range dbrps {
+			if v == dbrp {
+				exist = true
+				break
+			}
+		}
+		if !exist {
+			dbrps = append(dbrps, dbrp)
+		}
+	}
+	return dbrps
+}
+
+// taskID is the kapacitor task ID of the alarm.
+func taskID(alarm Alarm) string {
+	if alarm.TaskID != "" {
+		return alarm.TaskID
+	}
+	return alarm.Version
+}
+
+func taskStatus(alarm Alarm) client.TaskStatus {
+	if alarm.Enable == "true" {
+		return client.Enabled
+	}
+	return client.Disabled
+}
+
+// removeTaskAt deletes the task from the given nodes.
+func (k *Kapacitor) removeTaskAt(ctx context.Context, urls []string, id string) error {
+	var errs []error
+	for _, url := range urls {
+		k.mu.RLock()
+		c, ok := k.Clients[url]
+		k.mu.RUnlock()
+		if !ok {
+			log.Errorf("get cache kapacitor client failed %s", taskFields(id, url))
+			errs = append(errs, fmt.Errorf("get cache kapacitor %s client failed", url))
+			continue
+		}
+		log.Infof("delete stray task %s", taskFields(id, url))
+		err := k.acquireNode(ctx, url)
+		if err == nil {
+			err = callContext(ctx, func() error {
+				return c.DeleteTask(c.TaskLink(id))
+			})
+			k.releaseNode(url)
+		}
+		if err != nil {
+			log.Errorf("delete task failed %s: %s", taskFields(id, url), err)
+			errs = append(errs, err)
+		}
+	}
+	return joinErrors(errs)
+}
+
 func (k *Kapacitor) RemoveTask(task client.Task) error {
-	if !strings.Contains(task.ID, root+models.VersionSep) {
-		log.Errorf("this task not belong to loda: %s", task.ID)
-		return fmt.Errorf("this task not belong to loda: %s", task.ID)
+	return k.RemoveTaskContext(context.Background(), task)
+}
+
+func (k *Kapacitor) RemoveTaskContext(ctx context.Context, task client.Task) (err error) {
+	defer k.count(func(s *Stats) {
+		if err != nil {
+			s.RemoveFailures++
+		} else {
+			s.Removed++
+		}
+	})
+	if !k.owns(task.ID) {
+		log.Errorf("this task not belong to %s %s", k.Root, taskFields(task.ID, ""))
+		return fmt.Errorf("this task not belong to %s: %s", k.Root, task.ID)
 	}
-	log.Infof("delete task:%s", task.ID)
-	// try delete the task at all clients
-	k.mu.RLock()
-	defer k.mu.RUnlock()
-	for url, c := range k.Clients {
-		go func(id string) {
-			err := c.DeleteTask(c.TaskLink(id))
-			if err != nil {
-				log.Errorf("delete task at %s failed: %s", url, err)
+	if k.BeforeRemove != nil {
+		if err := k.BeforeRemove(task); err != nil {
+			log.Errorf("keep task definition failed %s: %s", taskFields(task.ID, ""), err)
+			return fmt.Errorf("keep task %s definition failed: %s", task.ID, err)
+		}
+	}
+	log.Infof("delete task %s", taskFields(task.ID, ""))
+	clients, err := k.removeClients(task.ID)
+	if err != nil {
+		log.Errorf("hash task failed %s: %s", taskFields(task.ID, ""), err)
+		return err
+	}
+
+	var wg sync.WaitGroup
+	var errmu sync.Mutex
+	var failed, unreachable []error
+	for url, c := range clients {
+		wg.Add(1)
+		go func(url string, c Client, id string) {
+			defer wg.Done()
+			err := k.acquireNode(ctx, url)
+			if err == nil {
+				err = callContext(ctx, func() error {
+					return c.DeleteTask(c.TaskLink(id))
+				})
+				k.releaseNode(url)
+			}
+			if err == nil || taskNotExist(err) {
+				return
 			}
-		}(task.ID)
+			errmu.Lock()
+			defer errmu.Unlock()
+			if err == ctx.Err() {
+				failed = append(failed, err)
+				return
+			}
+			if _, ok := err.(net.Error); ok {
+				log.Warningf("delete task failed, node unreachable %s: %s", taskFields(id, url), err)
+				unreachable = append(unreachable, fmt.Errorf("%s unreachable: %s", url, err))
+				return
+			}
+			log.Errorf("delete task failed %s: %s", taskFields(id, url), err)
+			failed = append(failed, fmt.Errorf("delete task at %s failed: %s", url, err))
+		}(url, c, task.ID)
+	}
+	wg.Wait()
+
+	if len(failed) > 0 {
+		return joinErrors(failed)
+	}
+	// a down node doesn't have a running task, only fail if no node is reachable
+	if len(unreachable) > 0 && len(unreachable) == len(clients) {
+		return joinErrors(unreachable)
 	}
 	return nil
 }
 
-func (k *Kapacitor) hashKapacitor(id string) string {
-	choose, err := k.Hash.Get(id)
+// removeClients returns the clients of the nodes to delete the task from
+// by RemovePolicy.
+func (k *Kapacitor) removeClients(id string) (map[string]Client, error) {
+	if k.RemovePolicy != RemoveOwner {
+		// try delete the task at all clients
+		k.mu.RLock()
+		defer k.mu.RUnlock()
+		clients := make(map[string]Client, len(k.Clients))
+		for url, c := range k.Clients {
+			clients[url] = c
+		}
+		return clients, nil
+	}
+	owner, err := k.hashKapacitor(id)
 	if err != nil {
-		log.Errorf("hash get server failed:%s", err)
-		if len(k.Addrs) > 0 {
-			return k.Addrs[0]
+		return nil, err
+	}
+	urls := append([]string{owner}, k.nodesOf(id)...)
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	clients := make(map[string]Client, len(urls))
+	for _, url := range urls {
+		if c, ok := k.Clients[url]; ok {
+			clients[url] = c
 		}
-		return ""
 	}
-	return choose
+	return clients, nil
 }
 
-func genTimeLambda(STime, ETime string) string {
-	if STime == "" || ETime == "" {
-		return ""
+// acquireNode waits for a free slot of the node's NodeConcurrency slots,
+// so a mass cleanup doesn't flood a node with deletes.
+func (k *Kapacitor) acquireNode(ctx context.Context, url string) error {
+	select {
+	case k.nodeSemaphore(url) <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	stime, errStime := strconv.Atoi(STime)
-	etime, errEtime := strconv.Atoi(ETime)
-	if stime == etime || errStime != nil || errEtime != nil {
-		log.Warningf("gen time lambda for tick fail, stime: %s, etime: %s", STime, ETime)
-		return ""
+}
+
+func (k *Kapacitor) releaseNode(url string) {
+	<-k.nodeSemaphore(url)
+}
+
+func (k *Kapacitor) nodeSemaphore(url string) chan struct{} {
+	k.nodeSemmu.Lock()
+	defer k.nodeSemmu.Unlock()
+	if k.nodeSem == nil {
+		k.nodeSem = make(map[string]chan struct{})
+	}
+	sem, ok := k.nodeSem[url]
+	if !ok {
+		n := k.NodeConcurrency
+		if n <= 0 {
+			n = defaultNodeConcurrency
+		}
+		sem = make(chan struct{}, n)
+		k.nodeSem[url] = sem
 	}
+	return sem
+}
 
-	condition := "AND"
-	if stime > etime {
-		condition = "OR"
+// owns reports whether the task is under Root, i.e. managed by the adapter.
+func (k *Kapacitor) owns(id string) bool {
+	return strings.Contains(id, k.Root+models.VersionSep)
+}
+
+// taskNotExist reports whether the delete error means the node doesn't have the task.
+func taskNotExist(err error) bool {
+	return strings.Contains(err.Error(), "not exist") || strings.Contains(err.Error(), "no task exists")
+}
+
+// GetTask fetches the task from its hashed node only,
+// the version is the task ID, i.e. the alarm version unless the alarm has its TaskID.
+func (k *Kapacitor) GetTask(version string) (client.Task, error) {
+	return k.GetTaskContext(context.Background(), version)
+}
+
+func (k *Kapacitor) GetTaskContext(ctx context.Context, version string) (client.Task, error) {
+	url, err := k.hashKapacitor(version)
+	if err != nil {
+		return client.Task{}, err
+	}
+	k.mu.RLock()
+	c, ok := k.Clients[url]
+	k.mu.RUnlock()
+	if !ok {
+		return client.Task{}, fmt.Errorf("get cache kapacitor %s client failed", url)
+	}
+	var opts client.TaskOptions
+	opts.Default()
+	opts.ScriptFormat = "raw"
+	var task client.Task
+	err = callContext(ctx, func() error {
+		var err error
+		task, err = c.Task(c.TaskLink(version), &opts)
+		return err
+	})
+	if err != nil {
+		return client.Task{}, fmt.Errorf("get task %s at %s failed: %s", version, url, err)
 	}
-	return fmt.Sprintf("AND (hour(\"time\") >= %s %s hour(\"time\") <= %s)", STime, condition, ETime)
+	return task, nil
+}
+
+// OwnerOf returns the url of the kapacitor node the task ID is hashed to.
+func (k *Kapacitor) OwnerOf(version string) (string, error) {
+	return k.hashKapacitor(version)
 }
 
-func (k *Kapacitor) genTick(alarm models.Alarm) (string, error) {
-	var queryWhere, groupby, offset string
-	if alarm.Where != "" {
-		queryWhere = "WHERE " + alarm.Where
+func (k *Kapacitor) hashKapacitor(id string) (string, error) {
+	urls, err := k.candidates(id)
+	if err != nil {
+		return "", err
 	}
-	timeLambda := genTimeLambda(alarm.STime, alarm.ETime)
+	return urls[0], nil
+}
 
-	groupby = alarm.GroupBy
-	if groupby != "*" {
-		groupby = "time(1m,-5s)"
-		tags := strings.Split(alarm.GroupBy, ",")
-		for _, tag := range tags {
-			if tag == "" {
-				continue
-			}
-			groupby = fmt.Sprintf("%s, '%s'", groupby, tag)
-		}
-		offset = `.align()
-.offset(5s)`
-	}
-	var res string
-	switch alarm.Trigger {
-	case models.Relative:
-		batch := `
-batch
-    |query('''
-        SELECT (max("value")-min("value")) as diff
-        FROM "%s"."%s"."%s" %s
-    ''')
-        .period(%s)
-        .every(%s)
-        .groupBy(%s)
-        %s
-    |alert()
-        .crit(lambda: "diff" %s %s %s)
-        .post('%s?version=%s')`
-		res = fmt.Sprintf(batch, alarm.DB, alarm.RP, alarm.Measurement, queryWhere, alarm.Period, alarm.Every,
-			groupby, offset, alarm.Expression, alarm.Value, timeLambda, k.EventAddr, alarm.Version)
-
-	case models.ThresHold:
-		batch := `
-batch
-    |query('''
-        SELECT %s(value)
-        FROM "%s"."%s"."%s" %s
-    ''')
-        .period(%s)
-        .every(%s)
-        .groupBy(%s)
-        %s
-    |alert()
-        .crit(lambda: "%s" %s %s %s)
-        .post('%s?version=%s')`
-		res = fmt.Sprintf(batch, alarm.Func, alarm.DB, alarm.RP, alarm.Measurement, queryWhere, alarm.Period, alarm.Every,
-			groupby, offset, alarm.Func, alarm.Expression, alarm.Value, timeLambda, k.EventAddr, alarm.Version)
-	default:
-		return "", fmt.Errorf("unknown alarm type: %s", models.DeadMan)
-	}
-	return res, nil
+// HashByVersion is the default HashKey, every alarm is hashed on its own
+// task ID, so a stable TaskID keeps the node across the version bumps.
+func HashByVersion(alarm Alarm) string {
+	return taskID(alarm)
+}
+
+// HashByMeasurement is the HashKey putting the alarms of the same
+// measurement on the same node, e.g. for the query cache locality.
+func HashByMeasurement(alarm Alarm) string {
+	return alarm.DB + "." + alarm.RP + "." + alarm.Measurement
+}
+
+// setHashKeys replaces the hash keys of the task IDs with the
+// keys of alarms, the keys of the removed alarms are dropped.
+func (k *Kapacitor) setHashKeys(alarms map[string]Alarm) {
+	if k.HashKey == nil {
+		return
+	}
+	keys := make(map[string]string, len(alarms))
+	for _, alarm := range alarms {
+		keys[taskID(alarm)] = k.HashKey(alarm)
+	}
+	k.mu.Lock()
+	k.hashKeys = keys
+	k.mu.Unlock()
+}
+
+func (k *Kapacitor) setHashKey(alarm Alarm) {
+	if k.HashKey == nil {
+		return
+	}
+	key := k.HashKey(alarm)
+	k.mu.Lock()
+	if k.hashKeys == nil {
+		k.hashKeys = make(map[string]string)
+	}
+	k.hashKeys[taskID(alarm)] = key
+	k.mu.Unlock()
+}
+
+// candidates returns the nodes the task may be created at in order,
+// the hashed node only with FailClosed, or the healthy nodes walking
+// the ring from the hashed node with FailOpen.
+func (k *Kapacitor) candidates(id string) ([]string, error) {
+	k.mu.RLock()
+	hash := k.Hash
+	policy := k.FailPolicy
+	// the tasks not seen with their alarm yet are hashed by their IDs
+	if key, ok := k.hashKeys[id]; ok {
+		id = key
+	}
+	k.mu.RUnlock()
+	if policy != FailOpen {
+		choose, err := hash.Get(id)
+		if err == ErrEmptyCircle {
+			return nil, ErrNoKapacitor
+		}
+		if err != nil {
+			return nil, err
+		}
+		return []string{choose}, nil
+	}
+
+	nodes, err := hash.GetN(id, len(hash.Members()))
+	if err == ErrEmptyCircle {
+		return nil, ErrNoKapacitor
+	}
+	if err != nil {
+		return nil, err
+	}
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	var urls []string
+	for _, url := range nodes {
+		if _, ok := k.Clients[url]; ok && !k.unhealthy[url] && !k.drained[url] {
+			urls = append(urls, url)
+		}
+	}
+	if len(urls) == 0 {
+		return nil, ErrNoKapacitor
+	}
+	return urls, nil
 }
@@ -0,0 +1,453 @@
+package adapter
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/influxdata/kapacitor/client/v1"
+)
+
+var testAddrs = []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}
+
+func TestCreateTask(t *testing.T) {
+	outOfRoot := testAlarm("other__cpu__1")
+	invalid := testAlarm("loda__cpu__2")
+	invalid.Expression = "=~"
+	disabled := testAlarm("loda__cpu__3")
+	disabled.Enable = "false"
+
+	tests := []struct {
+		name    string
+		alarm   Alarm
+		exists  bool
+		err     string
+		status  client.TaskStatus
+		creates int
+	}{
+		{name: "new", alarm: testAlarm("loda__cpu__1"), status: client.Enabled, creates: 1},
+		{name: "disabled", alarm: disabled, status: client.Disabled, creates: 1},
+		{name: "already exists", alarm: testAlarm("loda__cpu__1"), exists: true, status: client.Enabled, creates: 1},
+		{name: "out of root", alarm: outOfRoot, err: "not under loda"},
+		{name: "invalid", alarm: invalid, err: "expression"},
+	}
+	for _, tt := range tests {
+		k, fakes := newTestKapacitor(t, Options{}, testAddrs...)
+		id := taskID(tt.alarm)
+		owner, err := k.hashKapacitor(id)
+		if err != nil {
+			t.Fatalf("%s: hash failed: %s", tt.name, err)
+		}
+		if tt.exists {
+			fakes[owner].put(client.Task{ID: id, Status: client.Enabled})
+		}
+
+		task, err := k.CreateTask(tt.alarm)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("%s: create failed: %s", tt.name, err)
+		} else if task.ID != id {
+			t.Errorf("%s: got task %q, want %q", tt.name, task.ID, id)
+		}
+
+		var creates int
+		for url, f := range fakes {
+			creates += len(f.creates)
+			if url != owner && len(f.creates) > 0 {
+				t.Errorf("%s: task created at %s, not the owner %s", tt.name, url, owner)
+			}
+		}
+		if creates != tt.creates {
+			t.Errorf("%s: got %d creates, want %d", tt.name, creates, tt.creates)
+		}
+		if tt.err != "" {
+			continue
+		}
+		got := fakes[owner].tasks[id]
+		if got.Status != tt.status {
+			t.Errorf("%s: got status %v, want %v", tt.name, got.Status, tt.status)
+		}
+		if !tt.exists && !strings.Contains(got.TICKscript, "FROM \"loda.db\".\"loda\".\"cpu.idle\"") {
+			t.Errorf("%s: unexpected script:\n%s", tt.name, got.TICKscript)
+		}
+	}
+}
+
+func TestRemoveTask(t *testing.T) {
+	tests := []struct {
+		name      string
+		id        string
+		on        []int
+		deleteErr error
+		err       string
+		left      bool
+	}{
+		{name: "on owner", id: "loda__cpu__1", on: []int{0}},
+		{name: "on all", id: "loda__cpu__1", on: []int{0, 1, 2}},
+		{name: "on none", id: "loda__cpu__1"},
+		{name: "out of root", id: "other__cpu__1", on: []int{0}, err: "not belong to loda", left: true},
+		{name: "delete failed", id: "loda__cpu__1", on: []int{0}, deleteErr: errors.New("invalid response: code 400"), err: "code 400", left: true},
+	}
+	for _, tt := range tests {
+		k, fakes := newTestKapacitor(t, Options{}, testAddrs...)
+		var node0 *fakeClient
+		for i, addr := range testAddrs {
+			f := fakes[k.fullAddr(addr)]
+			if i == 0 {
+				node0 = f
+			}
+			f.deleteErr = tt.deleteErr
+			for _, on := range tt.on {
+				if on == i {
+					f.put(client.Task{ID: tt.id})
+				}
+			}
+		}
+
+		err := k.RemoveTask(client.Task{ID: tt.id})
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("%s: remove failed: %s", tt.name, err)
+		}
+		if left := node0.has(tt.id); left != tt.left && len(tt.on) > 0 {
+			t.Errorf("%s: task left %v, want %v", tt.name, left, tt.left)
+		}
+		if tt.left {
+			continue
+		}
+		for url, f := range fakes {
+			if f.has(tt.id) {
+				t.Errorf("%s: task still at %s", tt.name, url)
+			}
+		}
+	}
+}
+
+func TestTasks(t *testing.T) {
+	k, fakes := newTestKapacitor(t, Options{}, testAddrs...)
+	url0, url1 := k.fullAddr(testAddrs[0]), k.fullAddr(testAddrs[1])
+	fakes[url0].put(client.Task{ID: "loda__cpu__1"})
+	fakes[url0].put(client.Task{ID: "other__cpu__1"})
+	fakes[url1].put(client.Task{ID: "loda__cpu__1"})
+	fakes[url1].put(client.Task{ID: "loda__mem__1", Error: "bad field"})
+	fakes[k.fullAddr(testAddrs[2])].listErr = errors.New("connection refused")
+
+	tasks := k.Tasks()
+	var ids []string
+	for id := range tasks {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	if want := []string{"loda__cpu__1", "loda__mem__1"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("got tasks %v, want %v", ids, want)
+	}
+	if got, want := k.Duplicates(), map[string][]string{"loda__cpu__1": {url0, url1}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got duplicates %v, want %v", got, want)
+	}
+	if _, ok := k.TaskErrors()["loda__mem__1"]; !ok || len(k.TaskErrors()) != 1 {
+		t.Errorf("got task errors %v, want loda__mem__1 only", k.TaskErrors())
+	}
+}
+
+func TestPlanAndWork(t *testing.T) {
+	same := testAlarm("loda__same__1")
+	changed := testAlarm("loda__changed__1")
+	disabled := testAlarm("loda__disabled__1")
+	dbrps := testAlarm("loda__dbrps__1")
+	created := testAlarm("loda__created__1")
+	alarms := map[string]Alarm{}
+	for _, alarm := range []Alarm{same, changed, disabled, dbrps, created} {
+		alarms[alarm.Version] = alarm
+	}
+
+	k, fakes := newTestKapacitor(t, Options{}, testAddrs...)
+	// the tasks as the alarms were before
+	put := func(alarm Alarm, f func(task *client.Task)) {
+		owner, err := k.hashKapacitor(taskID(alarm))
+		if err != nil {
+			t.Fatalf("hash failed: %s", err)
+		}
+		tick, err := k.genTick(alarm)
+		if err != nil {
+			t.Fatalf("gen tick failed: %s", err)
+		}
+		task := client.Task{
+			ID:         taskID(alarm),
+			Type:       client.BatchTask,
+			DBRPs:      taskDBRPs(alarm),
+			TICKscript: k.withNode(tick, owner),
+			Status:     taskStatus(alarm),
+		}
+		if f != nil {
+			f(&task)
+		}
+		fakes[owner].put(task)
+	}
+	put(same, nil)
+	put(changed, func(task *client.Task) { task.TICKscript = strings.Replace(task.TICKscript, "< 10", "< 20", 1) })
+	put(disabled, func(task *client.Task) { task.Status = client.Disabled })
+	put(dbrps, func(task *client.Task) { task.DBRPs = []client.DBRP{{Database: "old", RetentionPolicy: "loda"}} })
+	fakes[k.fullAddr(testAddrs[0])].put(client.Task{ID: "loda__removed__1"})
+
+	versions := func(alarms []Alarm) []string {
+		var vs []string
+		for _, alarm := range alarms {
+			vs = append(vs, alarm.Version)
+		}
+		sort.Strings(vs)
+		return vs
+	}
+	plan := k.Plan(k.Tasks(), alarms)
+	tests := []struct {
+		name string
+		got  []string
+		want []string
+	}{
+		{"create", versions(plan.Create), []string{created.Version}},
+		{"update", versions(plan.Update), []string{changed.Version, dbrps.Version}},
+		{"set status", versions(plan.SetStatus), []string{disabled.Version}},
+	}
+	for _, tt := range tests {
+		if !reflect.DeepEqual(tt.got, tt.want) {
+			t.Errorf("plan %s: got %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+	if len(plan.Move) != 0 || len(plan.UpdateVars) != 0 || len(plan.Errors) != 0 {
+		t.Errorf("unexpected plan: %+v", plan)
+	}
+	if len(plan.Remove) != 1 || plan.Remove[0].ID != "loda__removed__1" {
+		t.Errorf("got remove %v, want loda__removed__1", plan.Remove)
+	}
+
+	if err := k.Work(k.Tasks(), alarms); err != nil {
+		t.Fatalf("work failed: %s", err)
+	}
+	plan = k.Plan(k.Tasks(), alarms)
+	if n := len(plan.Create) + len(plan.Move) + len(plan.Update) + len(plan.UpdateVars) +
+		len(plan.SetStatus) + len(plan.Remove) + len(plan.Errors); n != 0 {
+		t.Errorf("got %d changes after work, want none: %+v", n, plan)
+	}
+	if stats := k.Stats(); stats.LastReconcile.IsZero() {
+		t.Errorf("work didn't record the reconcile")
+	}
+}
+
+func TestWorkRingChange(t *testing.T) {
+	k, fakes := newTestKapacitor(t, Options{}, testAddrs[:2]...)
+	k.NewClient = func(config client.Config) (Client, error) {
+		f := newFakeClient()
+		fakes[config.URL] = f
+		return f, nil
+	}
+	alarms := make(map[string]Alarm)
+	for i := 0; i < 30; i++ {
+		alarm := testAlarm("loda__cpu__" + strconv.Itoa(i))
+		alarms[alarm.Version] = alarm
+	}
+	if err := k.Work(k.Tasks(), alarms); err != nil {
+		t.Fatalf("work failed: %s", err)
+	}
+	// a stray copy left by an earlier ring change
+	stray := taskID(alarms["loda__cpu__0"])
+	for _, f := range fakes {
+		if !f.has(stray) {
+			f.put(client.Task{ID: stray})
+		}
+	}
+
+	if err := k.SetAddr(testAddrs); err != nil {
+		t.Fatalf("set addr failed: %s", err)
+	}
+	plan := k.Plan(k.Tasks(), alarms)
+	if len(plan.Move) == 0 {
+		t.Fatalf("no task moved to the new node")
+	}
+	if err := k.Work(k.Tasks(), alarms); err != nil {
+		t.Fatalf("work after the ring change failed: %s", err)
+	}
+	for _, alarm := range alarms {
+		id := taskID(alarm)
+		owner, err := k.hashKapacitor(id)
+		if err != nil {
+			t.Fatalf("hash failed: %s", err)
+		}
+		for url, f := range fakes {
+			if has := f.has(id); has != (url == owner) {
+				t.Errorf("task %s at %s is %v, the owner is %s", id, url, has, owner)
+			}
+		}
+	}
+	k.Tasks()
+	if dups := k.Duplicates(); len(dups) != 0 {
+		t.Errorf("got duplicates %v after work", dups)
+	}
+}
+
+func TestRemoveTaskDeletesOncePerClient(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy RemovePolicy
+		on     int
+	}{
+		{name: "remove all, on all", policy: RemoveAll, on: 3},
+		{name: "remove all, on one", policy: RemoveAll, on: 1},
+		{name: "remove all, on none", policy: RemoveAll},
+		{name: "remove owner", policy: RemoveOwner, on: 1},
+	}
+	for _, tt := range tests {
+		k, fakes := newTestKapacitor(t, Options{RemovePolicy: tt.policy}, testAddrs...)
+		id := "loda__cpu__1"
+		owner, err := k.hashKapacitor(id)
+		if err != nil {
+			t.Fatalf("%s: hash failed: %s", tt.name, err)
+		}
+		n := 0
+		if tt.on > 0 {
+			fakes[owner].put(client.Task{ID: id})
+			n++
+		}
+		for url, f := range fakes {
+			if url != owner && n < tt.on {
+				f.put(client.Task{ID: id})
+				n++
+			}
+		}
+
+		if err := k.RemoveTask(client.Task{ID: id}); err != nil {
+			t.Errorf("%s: remove failed: %s", tt.name, err)
+		}
+		for url, f := range fakes {
+			want := 1
+			if tt.policy == RemoveOwner && url != owner {
+				want = 0
+			}
+			if len(f.deletes) > 1 || f.deletes[id] != want {
+				t.Errorf("%s: got deletes %v at %s, want %d of %s", tt.name, f.deletes, url, want, id)
+			}
+		}
+	}
+}
+
+func TestDrainRing(t *testing.T) {
+	k, fakes := newTestKapacitor(t, Options{}, testAddrs[:2]...)
+	url0, url1 := k.fullAddr(testAddrs[0]), k.fullAddr(testAddrs[1])
+	fakes[url0].pingErr = errors.New("connection refused")
+	k.checkHealth()
+	k.checkHealth()
+	if got := k.HealthyAddrs(); !reflect.DeepEqual(got, []string{url1}) {
+		t.Fatalf("got healthy %v, want %v", got, []string{url1})
+	}
+	if err := k.Drain(testAddrs[1]); err == nil || !strings.Contains(err.Error(), "last kapacitor node") {
+		t.Errorf("got drain error %v of the last node", err)
+	}
+	// the unhealthy node is drained out of the ring already
+	if err := k.Drain(testAddrs[0]); err != nil {
+		t.Errorf("drain the unhealthy node failed: %s", err)
+	}
+	fakes[url0].pingErr = nil
+	k.checkHealth()
+	if got := k.HealthyAddrs(); !reflect.DeepEqual(got, []string{url1}) {
+		t.Errorf("got healthy %v after the drained node recovered, want %v", got, []string{url1})
+	}
+	if err := k.Undrain(testAddrs[0]); err != nil {
+		t.Fatalf("undrain failed: %s", err)
+	}
+	if got := k.HealthyAddrs(); !reflect.DeepEqual(got, []string{url0, url1}) {
+		t.Errorf("got healthy %v after undrain, want %v", got, []string{url0, url1})
+	}
+	if k.Hash.count != 2 {
+		t.Errorf("got ring count %d, want 2", k.Hash.count)
+	}
+}
+
+func TestDrainKeepsTask(t *testing.T) {
+	k, fakes := newTestKapacitor(t, Options{}, testAddrs...)
+	alarm := testAlarm("loda__cpu__1")
+	alarm.VarThreshold = true
+	if _, err := k.CreateTask(alarm); err != nil {
+		t.Fatalf("create failed: %s", err)
+	}
+	from, err := k.hashKapacitor(taskID(alarm))
+	if err != nil {
+		t.Fatalf("hash failed: %s", err)
+	}
+	task := fakes[from].tasks[taskID(alarm)]
+	task.TemplateID = "loda-template"
+	fakes[from].put(task)
+
+	if err := k.Drain(from); err != nil {
+		t.Fatalf("drain failed: %s", err)
+	}
+	owner, err := k.hashKapacitor(taskID(alarm))
+	if err != nil || owner == from {
+		t.Fatalf("got owner %s after drain: %v", owner, err)
+	}
+	if fakes[from].has(task.ID) {
+		t.Errorf("task left on the drained node")
+	}
+	got, ok := fakes[owner].tasks[task.ID]
+	if !ok {
+		t.Fatalf("task not moved to %s", owner)
+	}
+	if got.TemplateID != task.TemplateID || !reflect.DeepEqual(got.Vars, task.Vars) || len(got.Vars) == 0 {
+		t.Errorf("got template %q vars %v, want %q %v", got.TemplateID, got.Vars, task.TemplateID, task.Vars)
+	}
+	if got.Status != task.Status || !reflect.DeepEqual(got.DBRPs, task.DBRPs) {
+		t.Errorf("got task %+v, want %+v", got, task)
+	}
+}
+
+func TestWorkBackoff(t *testing.T) {
+	k, fakes := newTestKapacitor(t, Options{}, testAddrs...)
+	for _, f := range fakes {
+		f.createErr = errors.New("invalid response: code 400: body: bad script")
+	}
+	alarm := testAlarm("loda__cpu__1")
+	creates := func() int {
+		var n int
+		for _, f := range fakes {
+			n += len(f.creates)
+		}
+		return n
+	}
+
+	tests := []struct {
+		name    string
+		value   string
+		err     bool
+		creates int
+	}{
+		{name: "failed", value: "10", err: true, creates: 1},
+		{name: "backed off", value: "10", creates: 1},
+		{name: "script changed", value: "20", err: true, creates: 2},
+		{name: "changed backed off", value: "20", creates: 2},
+	}
+	for _, tt := range tests {
+		alarm.Value = tt.value
+		err := k.Work(k.Tasks(), map[string]Alarm{alarm.Version: alarm})
+		if (err != nil) != tt.err {
+			t.Errorf("%s: got work error %v, want error %v", tt.name, err, tt.err)
+		}
+		if got := creates(); got != tt.creates {
+			t.Errorf("%s: got %d creates, want %d", tt.name, got, tt.creates)
+		}
+		if _, ok := k.Stuck()[alarm.Version]; !ok {
+			t.Errorf("%s: version not stuck", tt.name)
+		}
+		if !k.Stats().LastReconcile.IsZero() {
+			t.Errorf("%s: backed off work recorded a reconcile", tt.name)
+		}
+	}
+	if s := k.Stuck()[alarm.Version]; s.Failures != 1 {
+		t.Errorf("got %d failures of the changed script, want 1", s.Failures)
+	}
+}
@@ -0,0 +1,119 @@
+package adapter
+
+import (
+	"github.com/influxdata/kapacitor/client/v1"
+	"github.com/lodastack/log"
+)
+
+// Plan is the task changes Work would make to sync the alarms.
+type Plan struct {
+	// alarms without a task
+	Create []Alarm
+	// alarms whose task is not on the hashed node
+	Move []Move
+	// copies of the tasks on the nodes other than the hashed one,
+	// keyed by the task ID
+	Strays map[string][]string
+	// alarms whose TICK script or DBRPs are changed without a new version
+	Update []Alarm
+	// alarms whose threshold vars are changed only
+	UpdateVars []Alarm
+	// alarms whose Enable is changed only
+	SetStatus []Alarm
+	// tasks without an alarm
+	Remove []client.Task
+	// alarms failed to plan, e.g. an invalid alarm or no node in the ring
+	Errors []error
+}
+
+// Move is a task rehashed to another node by a ring change.
+type Move struct {
+	Alarm Alarm
+	// nodes the task is on now
+	From []string
+}
+
+// Plan compares the alarms with the tasks without changing any task,
+// e.g. to preview or approve the changes before Work. The tasks must come
+// from a fresh Tasks, the nodes of the tasks are the ones it found them on.
+func (k *Kapacitor) Plan(tasks map[string]client.Task, alarms map[string]Alarm) Plan {
+	plan := Plan{Strays: make(map[string][]string)}
+	// the hashed nodes of the alarms depend on their keys
+	k.setHashKeys(alarms)
+	wanted := make(map[string]bool, len(alarms))
+	for _, alarm := range alarms {
+		id := taskID(alarm)
+		wanted[id] = true
+		task, ok := tasks[id]
+		if !ok {
+			plan.Create = append(plan.Create, alarm)
+			continue
+		}
+		// the task should only exist on the hashed node,
+		// the copies on other nodes are left by ring changes
+		owner, err := k.hashKapacitor(id)
+		if err != nil {
+			plan.Errors = append(plan.Errors, err)
+			continue
+		}
+		var owned bool
+		var strays []string
+		for _, url := range k.nodesOf(id) {
+			if url == owner {
+				owned = true
+			} else {
+				strays = append(strays, url)
+			}
+		}
+		if !owned {
+			plan.Move = append(plan.Move, Move{Alarm: alarm, From: strays})
+			continue
+		}
+		if len(strays) > 0 {
+			plan.Strays[id] = strays
+		}
+		// the alarm may be changed without a new version
+		tick, err := k.genTick(alarm)
+		if err != nil {
+			log.Errorf("gen tick script failed %s: %s", alarmFields(alarm, ""), err)
+			plan.Errors = append(plan.Errors, err)
+			continue
+		}
+		if !CompareTick(stripVars(k.withNode(tick, owner)), stripVars(task.TICKscript)) ||
+			task.Type != client.BatchTask || !sameDBRPs(taskDBRPs(alarm), task.DBRPs) {
+			plan.Update = append(plan.Update, alarm)
+			continue
+		}
+		if alarm.VarThreshold && !sameVars(taskVars(alarm), task.Vars) {
+			plan.UpdateVars = append(plan.UpdateVars, alarm)
+		}
+		if taskStatus(alarm) != task.Status {
+			plan.SetStatus = append(plan.SetStatus, alarm)
+		}
+	}
+
+	for id, task := range tasks {
+		if !wanted[id] {
+			plan.Remove = append(plan.Remove, task)
+		}
+	}
+	return plan
+}
+
+// sameDBRPs reports whether the task is on the same databases and
+// retention policies in any order.
+func sameDBRPs(a, b []client.DBRP) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	set := make(map[client.DBRP]bool, len(a))
+	for _, d := range a {
+		set[d] = true
+	}
+	for _, d := range b {
+		if !set[d] {
+			return false
+		}
+	}
+	return true
+}
@@ -7,7 +7,6 @@ import (
 	"strings"
 
 	"github.com/lodastack/alarm-adapter/requests"
-	"github.com/lodastack/models"
 )
 
 // unit: min
@@ -18,14 +17,16 @@ const defaultPullInterval = 2
 const REGIntrannetIP = `^((192\.168|172\.([1][6-9]|[2]\d|3[01]))(\.([2][0-4]\d|[2][5][0-5]|[01]?\d?\d)){2}|10(\.([2][0-4]\d|[2][5][0-5]|[01]?\d?\d)){3})$`
 
 type Registry struct {
-	Addr     string
-	AlarmNS  string
+	Addr    string
+	AlarmNS string
+	// namespace of the alarms, the Root of the tasks
+	Root     string
 	Interval int
 }
 
 type RespAlarm struct {
-	Status int            `json:"httpstatus"`
-	Data   []models.Alarm `json:"data"`
+	Status int     `json:"httpstatus"`
+	Data   []Alarm `json:"data"`
 }
 
 type RespMachine struct {
@@ -37,19 +38,23 @@ type Machine struct {
 	IP string `json:"ip"`
 }
 
-func NewRegistry(addr string, alarmNS string) *Registry {
+func NewRegistry(addr string, alarmNS string, alarmRoot string) *Registry {
+	if alarmRoot == "" {
+		alarmRoot = root
+	}
 	r := &Registry{
 		Addr:     addr,
 		AlarmNS:  alarmNS,
+		Root:     alarmRoot,
 		Interval: defaultPullInterval,
 	}
 	return r
 }
 
-func (r *Registry) Alarms() (map[string]models.Alarm, error) {
+func (r *Registry) Alarms() (map[string]Alarm, error) {
 	var resp RespAlarm
-	alarms := make(map[string]models.Alarm)
-	url := fmt.Sprintf("%s/api/v1/alarm/resource?ns=%s&type=alarm", r.Addr, root)
+	alarms := make(map[string]Alarm)
+	url := fmt.Sprintf("%s/api/v1/alarm/resource?ns=%s&type=alarm", r.Addr, r.Root)
 	response, err := requests.Get(url)
 	if err != nil {
 		return alarms, err
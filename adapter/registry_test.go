@@ -0,0 +1,35 @@
+package adapter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRegistryAlarmsNamespace(t *testing.T) {
+	tests := []struct {
+		root string
+		want string
+	}{
+		{root: "", want: "loda"},
+		{root: "staging", want: "staging"},
+	}
+	for _, tt := range tests {
+		var ns string
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			ns = req.URL.Query().Get("ns")
+			w.Write([]byte(`{"httpstatus":200,"data":[{"version":"` + tt.want + `__cpu__1"}]}`))
+		}))
+		alarms, err := NewRegistry(ts.URL, "alarm.monitor.loda", tt.root).Alarms()
+		ts.Close()
+		if err != nil {
+			t.Fatalf("root %q: get alarms failed: %s", tt.root, err)
+		}
+		if ns != tt.want {
+			t.Errorf("root %q: got ns %q, want %q", tt.root, ns, tt.want)
+		}
+		if _, ok := alarms[tt.want+"__cpu__1"]; !ok {
+			t.Errorf("root %q: got alarms %v", tt.root, alarms)
+		}
+	}
+}
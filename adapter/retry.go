@@ -0,0 +1,47 @@
+package adapter
+
+import (
+	"context"
+	"net"
+	"regexp"
+	"time"
+
+	"github.com/lodastack/log"
+)
+
+// default retry settings of kapacitor calls
+const defaultMaxAttempts = 3
+const defaultRetryDelay = 500 * time.Millisecond
+
+// kapacitor client reports the unexpected responses without a JSON error
+// as "invalid response: code 503...", the ones with it as the bare error
+var serverErrorReg = regexp.MustCompile(`invalid response: code 5\d\d`)
+
+// retryable reports whether the error is transient,
+// e.g. network errors and 5xx responses.
+func retryable(err error) bool {
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	return serverErrorReg.MatchString(err.Error())
+}
+
+// retry calls f until it succeeds, fails permanently, runs out of attempts
+// or ctx is done, the delay doubles after every attempt.
+func (k *Kapacitor) retry(ctx context.Context, name string, f func() error) error {
+	var err error
+	delay := k.RetryDelay
+	for attempt := 1; ; attempt++ {
+		err = f()
+		if err == nil || attempt >= k.MaxAttempts || !retryable(err) {
+			return err
+		}
+		log.Warningf("%s failed at attempt %d, retry after %s: %s", name, attempt, delay, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		delay *= 2
+	}
+}
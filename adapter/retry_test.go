@@ -0,0 +1,27 @@
+package adapter
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, true},
+		{errors.New("invalid response: code 503"), true},
+		{errors.New("invalid response: code 500: body: oops"), true},
+		{errors.New("invalid response: code 404"), false},
+		{errors.New("invalid response: code 400: body: bad"), false},
+		{errors.New("task already exists"), false},
+		{errors.New("failed to parse TICKscript: invalid"), false},
+	}
+	for _, tt := range tests {
+		if got := retryable(tt.err); got != tt.want {
+			t.Errorf("retryable(%q) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
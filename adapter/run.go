@@ -0,0 +1,85 @@
+package adapter
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/lodastack/log"
+)
+
+// default interval of the reconcile loop
+const defaultRunInterval = time.Minute
+
+// Run syncs the kapacitor tasks with the alarms of alarmSource each interval
+// until ctx is done or Close. A pass runs to the end before the next one starts,
+// and the pass is skipped if alarmSource fails, so a registry outage doesn't
+// delete all the tasks.
+func (k *Kapacitor) Run(ctx context.Context, alarmSource func() (map[string]Alarm, error), interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultRunInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if !k.sleepJitter(ctx) {
+				return
+			}
+			k.reconcile(ctx, alarmSource)
+		case <-ctx.Done():
+			return
+		case <-k.done:
+			return
+		}
+	}
+}
+
+// own source of the jitter, so the adapters don't draw the same one and
+// the global source seeded by the importers is left alone
+var (
+	jittermu   sync.Mutex
+	jitterRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// jitter returns a random duration less than max.
+func jitter(max time.Duration) time.Duration {
+	jittermu.Lock()
+	defer jittermu.Unlock()
+	return time.Duration(jitterRand.Int63n(int64(max)))
+}
+
+// sleepJitter waits a random duration up to Jitter, so the adapters and
+// the periodic jobs sharing the nodes don't hit them at the same time.
+// It returns false if ctx is done or Close is called first.
+func (k *Kapacitor) sleepJitter(ctx context.Context) bool {
+	if k.Jitter <= 0 {
+		return true
+	}
+	timer := time.NewTimer(jitter(k.Jitter))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	case <-k.done:
+		return false
+	}
+}
+
+func (k *Kapacitor) reconcile(ctx context.Context, alarmSource func() (map[string]Alarm, error)) {
+	// the new nodes get the topic handler before the tasks
+	k.EnsureTopicHandlers(ctx)
+	tasks := k.TasksContext(ctx)
+	alarms, err := alarmSource()
+	if err != nil {
+		log.Errorf("get alarms failed:%s", err)
+		return
+	}
+	if err := k.WorkContext(ctx, tasks, alarms); err != nil {
+		log.Errorf("sync alarms failed:%s", err)
+	}
+}
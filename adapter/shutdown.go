@@ -0,0 +1,49 @@
+package adapter
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrShutdown is returned by the task changes started after Shutdown.
+var ErrShutdown = errors.New("kapacitor adapter is shut down")
+
+// Shutdown stops Run and HealthCheck and waits the in-flight Work and
+// CreateTasks passes until ctx is done, so the process doesn't exit with
+// half synced tasks, then closes the clients. The clients are kept if ctx
+// is done first since the passes may still be using them.
+func (k *Kapacitor) Shutdown(ctx context.Context) error {
+	k.inflightmu.Lock()
+	k.closing = true
+	k.inflightmu.Unlock()
+	k.closeOnce.Do(func() { close(k.done) })
+
+	finished := make(chan struct{})
+	go func() {
+		k.inflight.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	k.Close()
+	return nil
+}
+
+// begin tracks a pass of task changes for Shutdown,
+// it returns false after Shutdown.
+func (k *Kapacitor) begin() bool {
+	k.inflightmu.Lock()
+	defer k.inflightmu.Unlock()
+	if k.closing {
+		return false
+	}
+	k.inflight.Add(1)
+	return true
+}
+
+func (k *Kapacitor) end() {
+	k.inflight.Done()
+}
@@ -0,0 +1,146 @@
+package adapter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/influxdata/kapacitor/client/v1"
+	"github.com/lodastack/log"
+)
+
+// RestoreTask creates the task kept by BeforeRemove again on its hashed node,
+// e.g. to revert a removed alarm. The next Work removes it again if the alarm
+// is still missing in registry.
+func (k *Kapacitor) RestoreTask(task client.Task) error {
+	return k.RestoreTaskContext(context.Background(), task)
+}
+
+func (k *Kapacitor) RestoreTaskContext(ctx context.Context, task client.Task) error {
+	if !k.owns(task.ID) {
+		return fmt.Errorf("this task not belong to %s: %s", k.Root, task.ID)
+	}
+	url, err := k.hashKapacitor(task.ID)
+	if err != nil {
+		return err
+	}
+	k.mu.RLock()
+	c, ok := k.Clients[url]
+	k.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("get cache kapacitor %s client failed", url)
+	}
+	log.Infof("restore task %s", taskFields(task.ID, url))
+	err = callContext(ctx, func() error {
+		_, err := c.CreateTask(client.CreateTaskOptions{
+			ID:         task.ID,
+			TemplateID: task.TemplateID,
+			Type:       task.Type,
+			DBRPs:      task.DBRPs,
+			TICKscript: k.withNode(task.TICKscript, url),
+			Status:     task.Status,
+			Vars:       task.Vars,
+		})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("restore task %s at %s failed: %s", task.ID, url, err)
+	}
+	return nil
+}
+
+// TaskDefinition is what it takes to create a task again.
+type TaskDefinition struct {
+	ID         string            `json:"id"`
+	TemplateID string            `json:"template-id,omitempty"`
+	Type       client.TaskType   `json:"type"`
+	DBRPs      []client.DBRP     `json:"dbrps"`
+	TICKscript string            `json:"script"`
+	Status     client.TaskStatus `json:"status"`
+	Vars       client.Vars       `json:"vars,omitempty"`
+}
+
+// ExportTasks lists the tasks under Root on every node and returns their
+// definitions as JSON sorted by ID, e.g. for a backup. It fails rather than
+// returning a partial backup if a node can't be listed, a task on more than
+// one node is exported once.
+func (k *Kapacitor) ExportTasks() ([]byte, error) {
+	return k.ExportTasksContext(context.Background())
+}
+
+func (k *Kapacitor) ExportTasksContext(ctx context.Context) ([]byte, error) {
+	k.mu.RLock()
+	addrs := len(k.Addrs)
+	k.mu.RUnlock()
+	nodes := k.listNodeTasks(ctx)
+	if len(nodes) < addrs {
+		return nil, fmt.Errorf("only %d of %d kapacitor nodes listed", len(nodes), addrs)
+	}
+
+	tasks := make(map[string]client.Task)
+	var ids []string
+	for _, node := range nodes {
+		for _, t := range node.tasks {
+			if _, ok := tasks[t.ID]; ok || !k.owns(t.ID) {
+				continue
+			}
+			tasks[t.ID] = t
+			ids = append(ids, t.ID)
+		}
+	}
+	sort.Strings(ids)
+	defs := make([]TaskDefinition, 0, len(ids))
+	for _, id := range ids {
+		t := tasks[id]
+		defs = append(defs, TaskDefinition{
+			ID:         t.ID,
+			TemplateID: t.TemplateID,
+			Type:       t.Type,
+			DBRPs:      t.DBRPs,
+			TICKscript: t.TICKscript,
+			Status:     t.Status,
+			Vars:       t.Vars,
+		})
+	}
+	return json.Marshal(defs)
+}
+
+// ImportTasks creates the tasks of the ExportTasks JSON on their hashed
+// nodes, e.g. to rebuild a new cluster. The tasks already there are kept
+// as they are, the failed ones are logged and returned in the joined error.
+func (k *Kapacitor) ImportTasks(data []byte) error {
+	return k.ImportTasksContext(context.Background(), data)
+}
+
+func (k *Kapacitor) ImportTasksContext(ctx context.Context, data []byte) error {
+	var defs []TaskDefinition
+	if err := json.Unmarshal(data, &defs); err != nil {
+		return fmt.Errorf("decode task definitions failed: %s", err)
+	}
+	var created, existed int
+	var errs []error
+	for _, def := range defs {
+		err := k.RestoreTaskContext(ctx, client.Task{
+			ID:         def.ID,
+			TemplateID: def.TemplateID,
+			Type:       def.Type,
+			DBRPs:      def.DBRPs,
+			TICKscript: def.TICKscript,
+			Status:     def.Status,
+			Vars:       def.Vars,
+		})
+		switch {
+		case err == nil:
+			created++
+		case taskExists(err):
+			log.Debugf("task already exists %s", taskFields(def.ID, ""))
+			existed++
+		default:
+			log.Errorf("import task failed %s: %s", taskFields(def.ID, ""), err)
+			errs = append(errs, err)
+		}
+	}
+	log.Infof("import tasks done created=%d existed=%d failed=%d", created, existed, len(errs))
+	return joinErrors(errs)
+}
@@ -0,0 +1,30 @@
+package adapter
+
+import (
+	"time"
+)
+
+// Stats is the counters of the task changes made by Kapacitor.
+type Stats struct {
+	Created        int64
+	CreateFailures int64
+	Updated        int64
+	UpdateFailures int64
+	Removed        int64
+	RemoveFailures int64
+	// last time Work finished without error nor backed off creates
+	LastReconcile time.Time
+}
+
+// Stats returns a snapshot of the counters.
+func (k *Kapacitor) Stats() Stats {
+	k.statsmu.Lock()
+	defer k.statsmu.Unlock()
+	return k.stats
+}
+
+func (k *Kapacitor) count(f func(s *Stats)) {
+	k.statsmu.Lock()
+	f(&k.stats)
+	k.statsmu.Unlock()
+}
@@ -0,0 +1,153 @@
+package adapter
+
+import (
+	"context"
+	"sort"
+
+	"github.com/influxdata/kapacitor/client/v1"
+)
+
+// TaskInfo is the runtime state of a task on a kapacitor node.
+type TaskInfo struct {
+	ID             string
+	Node           string
+	Status         client.TaskStatus
+	Executing      bool
+	Error          string
+	ExecutionStats client.ExecutionStats
+}
+
+// Broken reports whether kapacitor accepted the task but it fails at runtime.
+func (t TaskInfo) Broken() bool {
+	return t.Error != "" || (t.Status == client.Enabled && !t.Executing)
+}
+
+// ListTasks returns the state of every task under Root on every node.
+func (k *Kapacitor) ListTasks() []TaskInfo {
+	var infos []TaskInfo
+	for _, node := range k.listNodeTasks(context.Background()) {
+		for _, t := range node.tasks {
+			if !k.owns(t.ID) {
+				continue
+			}
+			infos = append(infos, TaskInfo{
+				ID:             t.ID,
+				Node:           node.url,
+				Status:         t.Status,
+				Executing:      t.Executing,
+				Error:          t.Error,
+				ExecutionStats: t.ExecutionStats,
+			})
+		}
+	}
+	return infos
+}
+
+// TaskCounts returns the number of the tasks under Root hashed to each node
+// of the ring, e.g. to spot a hot node. The tasks are counted by the owner,
+// not the node they are on now, the nodes without a task count 0.
+// The nodes are listed without touching the tasks found by the last Tasks.
+func (k *Kapacitor) TaskCounts() map[string]int {
+	counts := make(map[string]int)
+	for _, url := range k.HealthyAddrs() {
+		counts[url] = 0
+	}
+	seen := make(map[string]bool)
+	for _, node := range k.listNodeTasks(context.Background()) {
+		for _, t := range node.tasks {
+			if !k.owns(t.ID) || seen[t.ID] {
+				continue
+			}
+			seen[t.ID] = true
+			url, err := k.hashKapacitor(t.ID)
+			if err != nil {
+				continue
+			}
+			counts[url]++
+		}
+	}
+	return counts
+}
+
+// RingInfo is the state of the hash ring, e.g. to tell why a task moved
+// nodes after a deploy.
+type RingInfo struct {
+	// sorted nodes in the ring
+	Members []string
+	// sorted nodes kept out of the ring
+	Unhealthy []string
+	Drained   []string
+	// weight of the nodes
+	Weights map[string]int
+	// hashed node of the given task IDs, empty if the ring is empty
+	Owners map[string]string
+}
+
+// Ring returns the state of the hash ring and where the task IDs land.
+func (k *Kapacitor) Ring(ids ...string) RingInfo {
+	info := RingInfo{
+		Members: k.HealthyAddrs(),
+		Weights: make(map[string]int),
+		Owners:  make(map[string]string, len(ids)),
+	}
+	k.mu.RLock()
+	for url := range k.unhealthy {
+		info.Unhealthy = append(info.Unhealthy, url)
+	}
+	for url := range k.drained {
+		info.Drained = append(info.Drained, url)
+	}
+	for url, weight := range k.weights {
+		info.Weights[url] = weight
+	}
+	k.mu.RUnlock()
+	sort.Strings(info.Unhealthy)
+	sort.Strings(info.Drained)
+
+	for _, id := range ids {
+		info.Owners[id], _ = k.hashKapacitor(id)
+	}
+	return info
+}
+
+// Misplacement is a task on a node other than its hashed owner.
+type Misplacement struct {
+	ID    string
+	Node  string
+	Owner string
+}
+
+// Audit lists the tasks under Root found on a node other than their hashed
+// owner, sorted by the task ID, e.g. to decide whether a rebalance is needed
+// after a ring change. A task on its owner and another node is listed for
+// the other node, the next Work removes or moves them. The nodes are listed
+// without touching the tasks found by the last Tasks.
+func (k *Kapacitor) Audit() []Misplacement {
+	taskNodes := make(map[string][]string)
+	for _, node := range k.listNodeTasks(context.Background()) {
+		for _, t := range node.tasks {
+			if k.owns(t.ID) {
+				taskNodes[t.ID] = append(taskNodes[t.ID], node.url)
+			}
+		}
+	}
+	ids := make([]string, 0, len(taskNodes))
+	for id := range taskNodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var misplaced []Misplacement
+	for _, id := range ids {
+		owner, err := k.hashKapacitor(id)
+		if err != nil {
+			continue
+		}
+		for _, url := range taskNodes[id] {
+			if url != owner {
+				misplaced = append(misplaced, Misplacement{ID: id, Node: url, Owner: owner})
+			}
+		}
+	}
+	return misplaced
+}
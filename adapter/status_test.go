@@ -0,0 +1,105 @@
+package adapter
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/influxdata/kapacitor/client/v1"
+)
+
+// newStatusKapacitor returns the adapter after a Tasks finding loda__cpu__1
+// on the first two nodes, the nodes get more tasks after it.
+func newStatusKapacitor(t *testing.T) (*Kapacitor, map[string]*fakeClient) {
+	k, fakes := newTestKapacitor(t, Options{}, testAddrs...)
+	url0, url1 := k.fullAddr(testAddrs[0]), k.fullAddr(testAddrs[1])
+	fakes[url0].put(client.Task{ID: "loda__cpu__1"})
+	fakes[url1].put(client.Task{ID: "loda__cpu__1"})
+	k.Tasks()
+	for i := 0; i < 10; i++ {
+		fakes[url0].put(client.Task{ID: "loda__mem__" + strconv.Itoa(i)})
+	}
+	fakes[url1].put(client.Task{ID: "other__cpu__1"})
+	return k, fakes
+}
+
+// checkSnapshot fails if the tasks found by the last Tasks are changed.
+func checkSnapshot(t *testing.T, k *Kapacitor, name string) {
+	url0, url1 := k.fullAddr(testAddrs[0]), k.fullAddr(testAddrs[1])
+	want := map[string][]string{"loda__cpu__1": {url0, url1}}
+	if got := k.Duplicates(); !reflect.DeepEqual(got, want) {
+		t.Errorf("%s changed the duplicates to %v, want %v", name, got, want)
+	}
+	if got := k.nodesOf("loda__mem__0"); got != nil {
+		t.Errorf("%s changed the nodes of a task to %v", name, got)
+	}
+}
+
+func TestTaskCounts(t *testing.T) {
+	k, _ := newStatusKapacitor(t)
+	counts := k.TaskCounts()
+	checkSnapshot(t, k, "TaskCounts")
+
+	var total int
+	for _, n := range counts {
+		total += n
+	}
+	// the duplicate is counted once, the task out of Root not at all
+	if total != 11 || len(counts) != len(testAddrs) {
+		t.Errorf("got counts %v, want 11 tasks on %d nodes", counts, len(testAddrs))
+	}
+}
+
+func TestAudit(t *testing.T) {
+	k, _ := newStatusKapacitor(t)
+	misplaced := k.Audit()
+	checkSnapshot(t, k, "Audit")
+
+	// the tasks under Root and the nodes they are on
+	url0, url1 := k.fullAddr(testAddrs[0]), k.fullAddr(testAddrs[1])
+	on := map[string][]string{"loda__cpu__1": {url0, url1}}
+	for i := 0; i < 10; i++ {
+		on["loda__mem__"+strconv.Itoa(i)] = []string{url0}
+	}
+	var want []Misplacement
+	for _, id := range []string{"loda__cpu__1", "loda__mem__0", "loda__mem__1", "loda__mem__2", "loda__mem__3",
+		"loda__mem__4", "loda__mem__5", "loda__mem__6", "loda__mem__7", "loda__mem__8", "loda__mem__9"} {
+		owner, err := k.hashKapacitor(id)
+		if err != nil {
+			t.Fatalf("hash failed: %s", err)
+		}
+		for _, url := range on[id] {
+			if url != owner {
+				want = append(want, Misplacement{ID: id, Node: url, Owner: owner})
+			}
+		}
+	}
+	if !reflect.DeepEqual(misplaced, want) {
+		t.Errorf("got misplacements %v, want %v", misplaced, want)
+	}
+}
+
+func TestListTasks(t *testing.T) {
+	k, fakes := newStatusKapacitor(t)
+	url1 := k.fullAddr(testAddrs[1])
+	fakes[url1].put(client.Task{ID: "loda__disk__1", Status: client.Enabled, Error: "bad field"})
+	infos := k.ListTasks()
+	checkSnapshot(t, k, "ListTasks")
+
+	var broken []string
+	for _, info := range infos {
+		if !k.owns(info.ID) {
+			t.Errorf("got task %s out of Root", info.ID)
+		}
+		if info.Broken() {
+			broken = append(broken, info.ID+"@"+info.Node)
+		}
+	}
+	// loda__cpu__1 twice, loda__mem__0-9 and loda__disk__1
+	if len(infos) != 13 {
+		t.Errorf("got %d tasks, want 13: %v", len(infos), infos)
+	}
+	if want := []string{"loda__disk__1@" + url1}; !reflect.DeepEqual(broken, want) {
+		t.Errorf("got broken %v, want %v", broken, want)
+	}
+}
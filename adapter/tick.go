@@ -0,0 +1,744 @@
+package adapter
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lodastack/log"
+	"github.com/lodastack/models"
+)
+
+// default deadman threshold and interval, used when the alarm leaves them empty
+const defaultDeadmanThreshold = "0.0"
+const defaultDeadmanInterval = "1m"
+
+// default field of the measurement to query
+const defaultField = "value"
+
+// default group by time window and offset
+const defaultWindow = "1m"
+const defaultOffset = "5s"
+
+// genTimeLambda limits the alert to the wall clock in loc from STime to ETime,
+// the window goes across midnight if STime > ETime. The times are hours or HH:MM,
+// a plain hour ETime covers the whole hour.
+// Kapacitor evaluates hour("time") in UTC, so the times are shifted by the
+// current offset of loc, the TICK changes on DST switches and Work updates it.
+func genTimeLambda(STime, ETime string, loc *time.Location) string {
+	if STime == "" || ETime == "" {
+		return ""
+	}
+	stime, sminute, errStime := parseClock(STime)
+	etime, eminute, errEtime := parseClock(ETime)
+	if stime == etime || errStime != nil || errEtime != nil {
+		log.Warningf("gen time lambda for tick fail, stime: %s, etime: %s", STime, ETime)
+		return ""
+	}
+	if !eminute {
+		etime += 59
+	}
+
+	var offset int
+	if loc != nil {
+		_, offset = time.Now().In(loc).Zone()
+	}
+	if !sminute && !eminute && offset%3600 == 0 {
+		return timeCondition(`hour("time")`, mod(stime/60-offset/3600, 24), mod(etime/60-offset/3600, 24))
+	}
+	// compare the minute of the day for HH:MM windows and zones like +05:30
+	start := mod(stime-offset/60, 24*60)
+	end := mod(etime-offset/60, 24*60)
+	return timeCondition(`(hour("time") * 60 + minute("time"))`, start, end)
+}
+
+func timeCondition(expr string, start, end int) string {
+	return "AND " + rangeCondition(expr, start, end)
+}
+
+// rangeCondition matches expr from start to end, wrapping around if start > end.
+func rangeCondition(expr string, start, end int) string {
+	condition := "AND"
+	if start > end {
+		condition = "OR"
+	}
+	return fmt.Sprintf("(%s >= %d %s %s <= %d)", expr, start, condition, expr, end)
+}
+
+// minutes of the day and the week in UTC, weekday("time") is 0 on Sunday
+const (
+	dayMinute  = `(hour("time") * 60 + minute("time"))`
+	weekMinute = `(weekday("time") * 1440 + hour("time") * 60 + minute("time"))`
+)
+
+// genWeekdayLambda limits the alert to the weekdays in loc, 0 is Sunday, and
+// to STime to ETime of the days if they are set, a window across midnight
+// ends on the next day. It's shifted to UTC like genTimeLambda.
+func genWeekdayLambda(STime, ETime string, weekdays []int, loc *time.Location) string {
+	start, end := 0, 24*60-1
+	if STime != "" && ETime != "" {
+		stime, _, errStime := parseClock(STime)
+		etime, _, errEtime := parseClock(ETime)
+		if stime != etime && errStime == nil && errEtime == nil {
+			start, end = windowMinutes(STime, ETime)
+		} else {
+			log.Warningf("gen time lambda for tick fail, stime: %s, etime: %s", STime, ETime)
+		}
+	}
+	conds := windowConditions(start, end, weekdays, zoneMinutes(loc))
+	return fmt.Sprintf("AND (%s)", strings.Join(conds, " OR "))
+}
+
+// genMuteLambda returns the condition false in the maintenance windows,
+// empty if there is none. The windows are shifted to UTC like genTimeLambda.
+func genMuteLambda(windows []Window, loc *time.Location) string {
+	if len(windows) == 0 {
+		return ""
+	}
+	offset := zoneMinutes(loc)
+	var conds []string
+	for _, w := range windows {
+		start, end := windowMinutes(w.Start, w.End)
+		conds = append(conds, windowConditions(start, end, w.Weekdays, offset)...)
+	}
+	return fmt.Sprintf("!(%s)", strings.Join(conds, " OR "))
+}
+
+// windowMinutes returns the minutes of the day from start to end, a plain
+// hour end covers the whole hour and end is on the next day if it's earlier.
+func windowMinutes(start, end string) (int, int) {
+	s, _, _ := parseClock(start)
+	e, endMinute, _ := parseClock(end)
+	if !endMinute {
+		e += 59
+	}
+	if e < s {
+		e += 24 * 60
+	}
+	return s, e
+}
+
+// windowConditions matches the minutes of the day from start to end on the
+// weekdays, or every day if none, shifted to UTC by offset minutes.
+func windowConditions(start, end int, weekdays []int, offset int) []string {
+	if len(weekdays) == 0 {
+		return []string{rangeCondition(dayMinute, mod(start-offset, 24*60), mod(end-offset, 24*60))}
+	}
+	var conds []string
+	for _, d := range weekdays {
+		day := d * 24 * 60
+		conds = append(conds, rangeCondition(weekMinute, mod(day+start-offset, 7*24*60), mod(day+end-offset, 7*24*60)))
+	}
+	return conds
+}
+
+// zoneMinutes returns the current offset of loc from UTC in minutes.
+func zoneMinutes(loc *time.Location) int {
+	if loc == nil {
+		return 0
+	}
+	_, offset := time.Now().In(loc).Zone()
+	return offset / 60
+}
+
+// mod returns the non-negative remainder of a divided by b.
+func mod(a, b int) int {
+	return (a%b + b) % b
+}
+
+// GenTick returns the TICK script of the alarm without contacting kapacitor.
+func (k *Kapacitor) GenTick(alarm Alarm) (string, error) {
+	return k.genTick(alarm)
+}
+
+func (k *Kapacitor) genTick(alarm Alarm) (string, error) {
+	if err := ValidateAlarm(alarm); err != nil {
+		return "", err
+	}
+	// the tasks out of the root are not listed nor removed by the adapter
+	if id := taskID(alarm); !k.owns(id) {
+		return "", fmt.Errorf("alarm %s: task id %s is not under %s", alarm.Version, id, k.Root)
+	}
+	var queryWhere, groupby, offset string
+	if alarm.Where != "" {
+		queryWhere = "WHERE " + alarm.Where
+	}
+	timeLambda := genTimeLambda(alarm.STime, alarm.ETime, k.Location)
+	if len(alarm.Weekdays) > 0 {
+		timeLambda = genWeekdayLambda(alarm.STime, alarm.ETime, alarm.Weekdays, k.Location)
+	}
+	if mute := genMuteLambda(alarm.Maintenance, k.Location); mute != "" {
+		timeLambda = strings.TrimSpace(timeLambda + " AND " + mute)
+	}
+
+	window := alarm.Window
+	if window == "" {
+		window = defaultWindow
+	}
+	windowOffset := alarm.Offset
+	if windowOffset == "" {
+		windowOffset = k.Offset
+	}
+	if windowOffset == "" {
+		windowOffset = defaultOffset
+	}
+
+	groupby = "*"
+	if !groupByAll(alarm) {
+		groupby = fmt.Sprintf("time(%s,-%s)", window, windowOffset)
+		if alarm.NoAlign {
+			groupby = fmt.Sprintf("time(%s)", window)
+		}
+		for _, tag := range groupByTags(alarm) {
+			groupby = fmt.Sprintf("%s, '%s'", groupby, tag)
+		}
+		if !alarm.NoAlign {
+			offset = fmt.Sprintf(`.align()
+.offset(%s)`, windowOffset)
+		}
+	}
+
+	// the aligned queries fire on the same boundaries, a staggered one fires
+	// later by cron and queries further back for the same windows
+	every := fmt.Sprintf(".every(%s)", alarm.Every)
+	var staggered time.Duration
+	if stagger := k.stagger(alarm); offset != "" && stagger > 0 {
+		if cron, ok := cronEvery(alarm.Every, stagger); ok {
+			d, _ := parseDuration(windowOffset)
+			every = fmt.Sprintf(".cron('%s')", cron)
+			offset = fmt.Sprintf(".offset(%s)", tickDuration(d+stagger))
+			staggered = stagger
+		}
+	}
+
+	queryField := alarm.Field
+	if queryField == "" {
+		queryField = defaultField
+	}
+
+	// field is the result of the query compared in the alert lambda,
+	// InfluxQL names the result after the func
+	var selector, field string
+	switch alarm.Trigger {
+	case models.Relative:
+		switch alarm.RelativeMode {
+		case RelativeLastFirst:
+			selector = fmt.Sprintf(`(last("%s")-first("%s")) as diff`, queryField, queryField)
+		case RelativeMean:
+			selector = fmt.Sprintf(`difference(mean("%s")) as diff`, queryField)
+		case RelativePercent:
+			selector = fmt.Sprintf(`mean("%s") as value`, queryField)
+		default:
+			selector = fmt.Sprintf(`(max("%s")-min("%s")) as diff`, queryField, queryField)
+		}
+		field = "diff"
+		if alarm.RelativeMode == RelativePercent {
+			field = "percent"
+		}
+	case models.ThresHold:
+		if alarm.FuncArgs != "" {
+			selector = fmt.Sprintf(`%s("%s", %s)`, alarm.Func, queryField, alarm.FuncArgs)
+		} else {
+			selector = fmt.Sprintf(`%s("%s")`, alarm.Func, queryField)
+		}
+		field = alarm.Func
+	case TriggerDerivative:
+		fn := alarm.Func
+		if fn == "" {
+			fn = "last"
+		}
+		selector = fmt.Sprintf(`%s("%s") as value`, fn, queryField)
+		field = "derivative"
+	case models.DeadMan:
+		selector = fmt.Sprintf(`count("%s")`, queryField)
+	default:
+		return "", fmt.Errorf("unknown alarm type: %s", alarm.Trigger)
+	}
+
+	batch := `
+batch
+    |query('''
+        SELECT %s
+        FROM %s %s
+    ''')
+        .period(%s)
+        %s
+        .groupBy(%s)
+        %s`
+	from := queryFrom(alarm)
+	res := fmt.Sprintf(batch, selector, from, queryWhere, alarm.Period, every, groupby, offset)
+	header := k.tickHeader(alarm)
+	if alarm.Trigger == models.DeadMan {
+		return header + res + k.genDeadman(alarm), nil
+	}
+	if alarm.Trigger == models.Relative && alarm.RelativeMode == RelativePercent {
+		// the previous period is queried one period earlier and shifted back
+		period, _ := parseDuration(alarm.Period)
+		pastOffset := fmt.Sprintf(".offset(%s)", tickDuration(period))
+		if offset != "" {
+			d, _ := parseDuration(windowOffset)
+			pastOffset = fmt.Sprintf(`.align()
+.offset(%s)`, tickDuration(period+d))
+			if staggered > 0 {
+				pastOffset = fmt.Sprintf(".offset(%s)", tickDuration(period+d+staggered))
+			}
+		}
+		past := fmt.Sprintf(batch, selector, from, queryWhere, alarm.Period, every, groupby, pastOffset)
+		return header + genVars(alarm) + genPercent(res, past, alarm.Period) + k.genAlert(alarm, field, timeLambda), nil
+	}
+	if alarm.Trigger == TriggerDerivative {
+		return header + genVars(alarm) + res + genDerivative(alarm) + k.genAlert(alarm, field, timeLambda), nil
+	}
+	return header + genVars(alarm) + res + k.genAlert(alarm, field, timeLambda), nil
+}
+
+// genDerivative generates the derivative node of the window values.
+func genDerivative(alarm Alarm) string {
+	unit := alarm.DerivativeUnit
+	if unit == "" {
+		unit = "1s"
+	}
+	derivative := fmt.Sprintf(`
+    |derivative('value')
+        .unit(%s)`, unit)
+	if alarm.NonNegative {
+		derivative += `
+        .nonNegative()`
+	}
+	return derivative + `
+        .as('derivative')`
+}
+
+// genVars declares the thresholds of the alarm as the vars crit and warn if
+// VarThreshold is set. They are floats whatever the values look like, the
+// vars of a task can't change their types.
+func genVars(alarm Alarm) string {
+	if !alarm.VarThreshold {
+		return ""
+	}
+	vars := fmt.Sprintf(`
+var crit = %s
+`, tickFloat(alarm.Value))
+	if alarm.WarnValue != "" {
+		vars += fmt.Sprintf(`var warn = %s
+`, tickFloat(alarm.WarnValue))
+	}
+	return vars
+}
+
+// tickFloat formats the number s as a TICK float literal.
+func tickFloat(s string) string {
+	f, _ := strconv.ParseFloat(s, 64)
+	s = strconv.FormatFloat(f, 'f', -1, 64)
+	if !strings.Contains(s, ".") {
+		s += ".0"
+	}
+	return s
+}
+
+// groupByAll reports whether the alarm groups by "*", every tag without
+// the time windows.
+func groupByAll(alarm Alarm) bool {
+	return strings.TrimSpace(alarm.GroupBy) == "*"
+}
+
+// groupByTags returns the tags of the comma separated GroupBy, the spaces
+// around the tags and the empty ones, e.g. of "" or ",", are dropped.
+func groupByTags(alarm Alarm) []string {
+	if groupByAll(alarm) {
+		return nil
+	}
+	var tags []string
+	for _, tag := range strings.Split(alarm.GroupBy, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// stagger returns the delay of the alarm's evaluation after the aligned
+// boundaries, the alarm's own or derived from the task ID by Stagger, so the
+// delay doesn't change with the version.
+func (k *Kapacitor) stagger(alarm Alarm) time.Duration {
+	if alarm.Stagger != "" {
+		d, _ := parseDuration(alarm.Stagger)
+		return d
+	}
+	if !k.Stagger {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write([]byte(taskID(alarm)))
+	return time.Duration(h.Sum32()%60) * time.Second
+}
+
+// cronEvery returns the cron expression, with seconds, firing stagger after
+// the boundaries of every. Only the minutes dividing an hour and the hours
+// dividing a day can be expressed.
+func cronEvery(every string, stagger time.Duration) (string, bool) {
+	d, err := parseDuration(every)
+	if err != nil || d <= 0 || d%time.Minute != 0 {
+		return "", false
+	}
+	sec := int(stagger / time.Second)
+	if m := int(d / time.Minute); m < 60 {
+		if 60%m != 0 {
+			return "", false
+		}
+		return fmt.Sprintf("%d */%d * * * * *", sec, m), true
+	}
+	if d%time.Hour != 0 {
+		return "", false
+	}
+	if h := int(d / time.Hour); h <= 24 && 24%h == 0 {
+		return fmt.Sprintf("%d 0 */%d * * * *", sec, h), true
+	}
+	return "", false
+}
+
+// tickHeader is the comment line of the TICK script telling the alarm,
+// e.g. for the kapacitor UI.
+func (k *Kapacitor) tickHeader(alarm Alarm) string {
+	header := fmt.Sprintf("// %s alarm version=%s db=%s rp=%s measurement=%s trigger=%s",
+		k.Root, alarm.Version, alarm.DB, alarm.RP, strings.Join(measurements(alarm), ","), alarm.Trigger)
+	if k.Environment != "" {
+		header += " env=" + k.Environment
+	}
+	// a newline would end the comment
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(header)
+}
+
+// genPercent joins the windows of the current period with the ones a period
+// earlier, and evaluates the change percent of the mean, 0 if the earlier
+// mean is 0.
+func genPercent(cur, past, period string) string {
+	return fmt.Sprintf(`
+var cur = %s
+
+var past = %s
+    |shift(%s)
+
+cur
+    |join(past)
+        .as('cur', 'past')
+    |eval(lambda: if("past.value" == 0.0, 0.0, ("cur.value" - "past.value") / "past.value" * 100.0))
+        .as('percent')`, strings.TrimPrefix(cur, "\n"), strings.TrimPrefix(past, "\n"), period)
+}
+
+// CompareTick reports whether the TICK scripts are the same ignoring the
+// whitespace outside the string literals, e.g. reformatted by kapacitor.
+func CompareTick(a, b string) bool {
+	return normalizeTick(a) == normalizeTick(b)
+}
+
+// normalizeTick collapses the whitespace outside the string literals to
+// one space, or none next to the punctuations.
+func normalizeTick(s string) string {
+	var buf bytes.Buffer
+	var last byte
+	space := false
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c == ' ' || c == '\t' || c == '\n' || c == '\r' {
+			space = true
+			i++
+			continue
+		}
+		if space && buf.Len() > 0 && !tickPunct(last) && !tickPunct(c) {
+			buf.WriteByte(' ')
+		}
+		space = false
+		n := tickTokenLen(s[i:])
+		buf.WriteString(s[i : i+n])
+		last = s[i+n-1]
+		i += n
+	}
+	return buf.String()
+}
+
+func tickPunct(c byte) bool {
+	return strings.IndexByte("|.(),", c) >= 0
+}
+
+// tickTokenLen returns the length of the string literal at the start of s,
+// or 1 if s doesn't start with a literal.
+func tickTokenLen(s string) int {
+	if strings.HasPrefix(s, "'''") {
+		if end := strings.Index(s[3:], "'''"); end >= 0 {
+			return end + 6
+		}
+		return len(s)
+	}
+	if s[0] != '\'' && s[0] != '"' {
+		return 1
+	}
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case s[0]:
+			return i + 1
+		}
+	}
+	return len(s)
+}
+
+// measurements returns Measurement and the extra Measurements of the alarm.
+func measurements(alarm Alarm) []string {
+	return append([]string{alarm.Measurement}, alarm.Measurements...)
+}
+
+// queryFrom returns the FROM clause of the alarm's measurements,
+// e.g. "db"."rp"."cpu", "db"."rp"."cpu2".
+func queryFrom(alarm Alarm) string {
+	var from []string
+	for _, m := range measurements(alarm) {
+		from = append(from, quoteIdent(alarm.DB)+"."+quoteIdent(alarm.RP)+"."+quoteIdent(m))
+	}
+	return strings.Join(from, ", ")
+}
+
+// quoteIdent double quotes the InfluxQL identifier, escaping the quotes and
+// backslashes in it, e.g. cpu"load becomes "cpu\"load".
+func quoteIdent(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	return `"` + s + `"`
+}
+
+// genAlert generates the alert node which compares field with the alarm value.
+// With Consecutive N > 1, of the alarms querying every period, the
+// stateCount nodes count the consecutive points breaching each level
+// first, and the alert checks the counts, e.g.
+//
+//	|stateCount(lambda: "mean" > 90)
+//	    .as('crit_count')
+//	|alert()
+//	    .crit(lambda: "crit_count" >= 3)
+func (k *Kapacitor) genAlert(alarm Alarm, field string, timeLambda string) string {
+	crit, warn := alarm.Value, alarm.WarnValue
+	if alarm.VarThreshold {
+		crit, warn = "crit", "warn"
+	}
+	critLambda := fmt.Sprintf(`"%s" %s %s`, field, alarm.Expression, crit)
+	var warnLambda string
+	alert := genAlertTags(alarm)
+	if alarm.WarnValue != "" {
+		expression := alarm.WarnExpression
+		if expression == "" {
+			expression = alarm.Expression
+		}
+		warnLambda = fmt.Sprintf(`"%s" %s %s`, field, expression, warn)
+	}
+	if alarm.Consecutive > 1 {
+		if warnLambda != "" {
+			alert += fmt.Sprintf(`
+    |stateCount(lambda: %s)
+        .as('warn_count')`, warnLambda)
+			warnLambda = fmt.Sprintf(`"warn_count" >= %d`, alarm.Consecutive)
+		}
+		alert += fmt.Sprintf(`
+    |stateCount(lambda: %s)
+        .as('crit_count')`, critLambda)
+		critLambda = fmt.Sprintf(`"crit_count" >= %d`, alarm.Consecutive)
+	}
+	alert += `
+    |alert()`
+	if warnLambda != "" {
+		alert += fmt.Sprintf(`
+        .warn(lambda: %s %s)`, warnLambda, timeLambda)
+	}
+	alert += fmt.Sprintf(`
+        .crit(lambda: %s %s)`, critLambda, timeLambda)
+	alert += alertOptions(alarm)
+	alert += k.genHandler(alarm)
+	return alert
+}
+
+// genAlertTags generates the default node setting the static alert tags,
+// sorted by name so the script is stable.
+func genAlertTags(alarm Alarm) string {
+	if len(alarm.AlertTags) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(alarm.AlertTags))
+	for name := range alarm.AlertTags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	tags := `
+    |default()`
+	for _, name := range names {
+		tags += fmt.Sprintf(`
+        .tag('%s', '%s')`, name, alarm.AlertTags[name])
+	}
+	return tags
+}
+
+// genDeadman generates the deadman node which alerts if the points
+// per interval drops below the threshold.
+func (k *Kapacitor) genDeadman(alarm Alarm) string {
+	threshold := alarm.DeadmanThreshold
+	if threshold == "" {
+		threshold = defaultDeadmanThreshold
+	}
+	interval := alarm.DeadmanInterval
+	if interval == "" {
+		interval = alarm.Every
+	}
+	if interval == "" {
+		interval = defaultDeadmanInterval
+	}
+	// the deadman node ANDs the extra lambda
+	var mute string
+	if lambda := genMuteLambda(alarm.Maintenance, k.Location); lambda != "" {
+		mute = ", lambda: " + lambda
+	}
+	deadman := fmt.Sprintf(`
+    |deadman(%s, %s%s)`, tickFloat(threshold), interval, mute)
+	deadman += alertOptions(alarm)
+	deadman += k.genHandler(alarm)
+	return deadman
+}
+
+// alertOptions generates the optional properties of the alert node.
+func alertOptions(alarm Alarm) string {
+	var options string
+	if alarm.StateChangesOnly {
+		options += `
+        .stateChangesOnly()`
+	}
+	if alarm.FlappingLow != "" && alarm.FlappingHigh != "" {
+		options += fmt.Sprintf(`
+        .flapping(%s, %s)`, alarm.FlappingLow, alarm.FlappingHigh)
+	}
+	if alarm.Message != "" {
+		options += fmt.Sprintf(`
+        .message('%s')`, alarm.Message)
+	}
+	if alarm.Details != "" {
+		options += fmt.Sprintf(`
+        .details('''%s''')`, alarm.Details)
+	}
+	if alarm.NoRecoveries {
+		options += `
+        .noRecoveries()`
+	}
+	return options
+}
+
+// genHandler generates the handler of the alert.
+func (k *Kapacitor) genHandler(alarm Alarm) string {
+	switch alarm.Handler {
+	case HandlerTCP:
+		return fmt.Sprintf(`
+        .tcp('%s')`, alarm.HandlerTarget)
+	case HandlerExec:
+		// the command gets the version like the event address does
+		return fmt.Sprintf(`
+        .exec('%s', '%s')`, alarm.HandlerTarget, alarm.Version)
+	case HandlerTopic:
+		return fmt.Sprintf(`
+        .topic('%s')`, alarm.HandlerTarget)
+	}
+	// the alarms sharing the global event address share the topic handler
+	if k.Topic != "" && alarm.EventAddr == "" {
+		return genGroupID(alarm) + fmt.Sprintf(`
+        .topic('%s')`, k.topic())
+	}
+	return k.genPost(alarm)
+}
+
+// genGroupID sets the alert id to "<version>:<group>", the group is the tags
+// like "host=a,region=b", so the receiver tells the series of the alarm.
+func genGroupID(alarm Alarm) string {
+	return fmt.Sprintf(`
+        .id('%s:{{ .Group }}')`, alarm.Version)
+}
+
+// genPost generates the post handler sending the alert to the event address.
+func (k *Kapacitor) genPost(alarm Alarm) string {
+	var post string
+	if k.GroupID {
+		post = genGroupID(alarm)
+	}
+	addrs := []string{k.eventAddr(alarm)}
+	// kapacitor can't fall back to a handler on failure, post to both
+	if alarm.EventAddr == "" && k.FallbackEventAddr != "" {
+		addrs = append(addrs, k.FallbackEventAddr)
+	}
+	for _, addr := range addrs {
+		post += fmt.Sprintf(`
+        .post('%s?version=%s%s')`, addr, alarm.Version, k.envQuery("&"))
+		// a slow event server would block the alerts of the task without timeout
+		if k.PostTimeout > 0 {
+			post += fmt.Sprintf(`
+        .timeout(%s)`, tickDuration(k.PostTimeout))
+		}
+		if k.CaptureResponse {
+			post += `
+        .captureResponse()`
+		}
+	}
+	return post
+}
+
+// header of the posts telling the kapacitor node of the task
+const nodeHeader = "X-Kapacitor-Node"
+
+var (
+	postReg       = regexp.MustCompile(`(?m)^        \.post\('[^']*'\)`)
+	nodeHeaderReg = regexp.MustCompile(`\n        \.header\('` + nodeHeader + `', '[^']*'\)`)
+)
+
+// withNode sets the node header of the posts in tick to url if NodeHeader
+// is enabled. The node is only known after hashing, so it's added to the
+// TICK script of the node rather than by genTick.
+func (k *Kapacitor) withNode(tick, url string) string {
+	if !k.NodeHeader {
+		return tick
+	}
+	tick = nodeHeaderReg.ReplaceAllString(tick, "")
+	return postReg.ReplaceAllStringFunc(tick, func(post string) string {
+		return fmt.Sprintf("%s\n        .header('%s', '%s')", post, nodeHeader, url)
+	})
+}
+
+// topic returns the alert topic of the Environment, e.g. "loda-staging".
+func (k *Kapacitor) topic() string {
+	if k.Environment == "" {
+		return k.Topic
+	}
+	return k.Topic + "-" + k.Environment
+}
+
+// envQuery returns the env query of the posts after sep, empty if
+// Environment is not set.
+func (k *Kapacitor) envQuery(sep string) string {
+	if k.Environment == "" {
+		return ""
+	}
+	return sep + "env=" + k.Environment
+}
+
+// tickDuration formats d as a TICK duration literal.
+func tickDuration(d time.Duration) string {
+	if d%time.Second == 0 {
+		return fmt.Sprintf("%ds", d/time.Second)
+	}
+	return fmt.Sprintf("%dms", d/time.Millisecond)
+}
+
+// eventAddr returns the alarm's own event address if set.
+func (k *Kapacitor) eventAddr(alarm Alarm) string {
+	if alarm.EventAddr != "" {
+		return alarm.EventAddr
+	}
+	return k.EventAddr
+}
@@ -0,0 +1,444 @@
+package adapter
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lodastack/models"
+)
+
+// genTestTick generates the script of the alarm by an adapter without nodes.
+func genTestTick(alarm Alarm) (string, error) {
+	k := &Kapacitor{EventAddr: "http://event", Root: root}
+	return k.genTick(alarm)
+}
+
+func TestGenTickWhere(t *testing.T) {
+	tests := []struct {
+		where string
+		want  string
+		err   bool
+	}{
+		{where: "", want: "FROM \"loda.db\".\"loda\".\"cpu.idle\" \n"},
+		{where: "host = 'a'", want: "WHERE host = 'a'\n"},
+		{where: `"host" =~ /^web-\d+$/`, want: `WHERE "host" =~ /^web-\d+$/` + "\n"},
+		{where: "host = 'a'''')|httpOut('x')|query('''SELECT 1", err: true},
+		{where: "'''", err: true},
+		{where: "host = ''''", err: true},
+	}
+	for _, tt := range tests {
+		alarm := testAlarm("loda__cpu__1")
+		alarm.Where = tt.where
+		tick, err := genTestTick(alarm)
+		if tt.err {
+			if err == nil {
+				t.Errorf("where %q: want error, got script:\n%s", tt.where, tick)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("where %q: gen tick failed: %s", tt.where, err)
+			continue
+		}
+		if !strings.Contains(tick, tt.want) {
+			t.Errorf("where %q: script doesn't contain %q:\n%s", tt.where, tt.want, tick)
+		}
+		// the query literal is closed once, by the adapter
+		if n := strings.Count(tick, "'''"); n != 2 {
+			t.Errorf("where %q: got %d ''' in script, want 2:\n%s", tt.where, n, tick)
+		}
+	}
+}
+
+func TestGenTickNoRecoveries(t *testing.T) {
+	for _, noRecoveries := range []bool{false, true} {
+		alarm := testAlarm("loda__cpu__1")
+		alarm.NoRecoveries = noRecoveries
+		tick, err := genTestTick(alarm)
+		if err != nil {
+			t.Fatalf("norecoveries %v: gen tick failed: %s", noRecoveries, err)
+		}
+		if got := strings.Contains(tick, ".noRecoveries()"); got != noRecoveries {
+			t.Errorf("norecoveries %v: got .noRecoveries() %v in script:\n%s", noRecoveries, got, tick)
+		}
+	}
+}
+
+var timeLambdaReg = regexp.MustCompile(`^AND \((.+) >= (\d+) (AND|OR) .+ <= (\d+)\)$`)
+
+// matchTimeLambda evaluates the lambda of genTimeLambda at the UTC minute of the day.
+func matchTimeLambda(t *testing.T, lambda string, utcMinute int) bool {
+	m := timeLambdaReg.FindStringSubmatch(lambda)
+	if m == nil {
+		t.Fatalf("unexpected time lambda %q", lambda)
+	}
+	v := utcMinute
+	if m[1] == `hour("time")` {
+		v = utcMinute / 60
+	}
+	start, _ := strconv.Atoi(m[2])
+	end, _ := strconv.Atoi(m[4])
+	if m[3] == "OR" {
+		return v >= start || v <= end
+	}
+	return v >= start && v <= end
+}
+
+func TestGenTimeLambda(t *testing.T) {
+	tests := []struct {
+		stime, etime string
+		loc          *time.Location
+		want         string
+		// the local window in minutes of the day, end included
+		start, end int
+	}{
+		{stime: "9", etime: "18", want: `AND (hour("time") >= 9 AND hour("time") <= 18)`, start: 9 * 60, end: 18*60 + 59},
+		{stime: "22", etime: "6", want: `AND (hour("time") >= 22 OR hour("time") <= 6)`, start: 22 * 60, end: 6*60 + 59},
+		{stime: "22:00", etime: "06:00", want: `AND ((hour("time") * 60 + minute("time")) >= 1320 OR (hour("time") * 60 + minute("time")) <= 360)`, start: 22 * 60, end: 6 * 60},
+		{stime: "22", etime: "6", loc: time.FixedZone("UTC+8", 8*3600), want: `AND (hour("time") >= 14 AND hour("time") <= 22)`, start: 22 * 60, end: 6*60 + 59},
+		{stime: "22:00", etime: "06:00", loc: time.FixedZone("UTC-5", -5*3600), start: 22 * 60, end: 6 * 60},
+		{stime: "22", etime: "6", loc: time.FixedZone("UTC+5:30", 5*3600+1800), start: 22 * 60, end: 6*60 + 59},
+		{stime: "8:30", etime: "17:45", loc: time.FixedZone("UTC+8", 8*3600), start: 8*60 + 30, end: 17*60 + 45},
+	}
+	for _, tt := range tests {
+		lambda := genTimeLambda(tt.stime, tt.etime, tt.loc)
+		if tt.want != "" && lambda != tt.want {
+			t.Errorf("%s-%s %v: got %s, want %s", tt.stime, tt.etime, tt.loc, lambda, tt.want)
+		}
+		var offset int
+		if tt.loc != nil {
+			_, offset = time.Now().In(tt.loc).Zone()
+		}
+		for utc := 0; utc < 24*60; utc++ {
+			local := mod(utc+offset/60, 24*60)
+			want := local >= tt.start && local <= tt.end
+			if tt.start > tt.end {
+				want = local >= tt.start || local <= tt.end
+			}
+			if got := matchTimeLambda(t, lambda, utc); got != want {
+				t.Errorf("%s-%s %v: %s matches %02d:%02d local %v, want %v",
+					tt.stime, tt.etime, tt.loc, lambda, local/60, local%60, got, want)
+				break
+			}
+		}
+	}
+}
+
+func TestGenTickQuoteIdents(t *testing.T) {
+	tests := []struct {
+		trigger     string
+		db, rp      string
+		measurement string
+		want        string
+	}{
+		{models.ThresHold, "loda.db", "loda", "cpu.idle", `FROM "loda.db"."loda"."cpu.idle"`},
+		{models.ThresHold, "loda-db", "rp-1", "net-in", `FROM "loda-db"."rp-1"."net-in"`},
+		{models.ThresHold, "db", "rp", `cpu"load`, `FROM "db"."rp"."cpu\"load"`},
+		{models.ThresHold, `d"b`, "rp", `cpu\load`, `FROM "d\"b"."rp"."cpu\\load"`},
+		{models.Relative, "loda.db", "loda", "cpu.idle", `FROM "loda.db"."loda"."cpu.idle"`},
+		{models.Relative, "db", `r"p`, `mem"used.percent-1`, `FROM "db"."r\"p"."mem\"used.percent-1"`},
+	}
+	for _, tt := range tests {
+		alarm := testAlarm("loda__cpu__1")
+		alarm.Trigger = tt.trigger
+		alarm.DB, alarm.RP, alarm.Measurement = tt.db, tt.rp, tt.measurement
+		tick, err := genTestTick(alarm)
+		if err != nil {
+			t.Errorf("%s %s: gen tick failed: %s", tt.trigger, tt.measurement, err)
+			continue
+		}
+		if !strings.Contains(tick, tt.want) {
+			t.Errorf("%s %s: script doesn't contain %s:\n%s", tt.trigger, tt.measurement, tt.want, tick)
+		}
+	}
+}
+
+func TestGenTickNoAlign(t *testing.T) {
+	tests := []struct {
+		noAlign bool
+		groupBy string
+		want    []string
+		absent  []string
+	}{
+		{groupBy: "host", want: []string{".groupBy(time(1m,-5s), 'host')", ".align()\n.offset(5s)"}},
+		{noAlign: true, groupBy: "host", want: []string{".groupBy(time(1m), 'host')"}, absent: []string{".align()", ".offset("}},
+		{noAlign: true, groupBy: "*", want: []string{".groupBy(*)"}, absent: []string{".align()", ".offset("}},
+	}
+	for _, tt := range tests {
+		alarm := testAlarm("loda__cpu__1")
+		alarm.NoAlign, alarm.GroupBy = tt.noAlign, tt.groupBy
+		tick, err := genTestTick(alarm)
+		if err != nil {
+			t.Errorf("noalign %v groupby %q: gen tick failed: %s", tt.noAlign, tt.groupBy, err)
+			continue
+		}
+		for _, s := range tt.want {
+			if !strings.Contains(tick, s) {
+				t.Errorf("noalign %v groupby %q: script doesn't contain %q:\n%s", tt.noAlign, tt.groupBy, s, tick)
+			}
+		}
+		for _, s := range tt.absent {
+			if strings.Contains(tick, s) {
+				t.Errorf("noalign %v groupby %q: script contains %q:\n%s", tt.noAlign, tt.groupBy, s, tick)
+			}
+		}
+	}
+}
+
+func TestGenTickDerivative(t *testing.T) {
+	tests := []struct {
+		fixture     string
+		unit        string
+		nonNegative bool
+	}{
+		{fixture: "derivative.tick"},
+		{fixture: "derivative_nonnegative.tick", unit: "1m", nonNegative: true},
+	}
+	for _, tt := range tests {
+		alarm := testAlarm("loda__net__1")
+		alarm.Trigger = TriggerDerivative
+		alarm.Measurement = "net.in"
+		alarm.Func = ""
+		alarm.Expression, alarm.Value = ">", "1000"
+		alarm.DerivativeUnit, alarm.NonNegative = tt.unit, tt.nonNegative
+		tick, err := genTestTick(alarm)
+		if err != nil {
+			t.Errorf("%s: gen tick failed: %s", tt.fixture, err)
+			continue
+		}
+		want, err := ioutil.ReadFile(filepath.Join("testdata", tt.fixture))
+		if err != nil {
+			t.Fatalf("read fixture failed: %s", err)
+		}
+		if tick != string(want) {
+			t.Errorf("%s: got script:\n%s\nwant:\n%s", tt.fixture, tick, want)
+		}
+	}
+}
+
+func TestGenTickConsecutive(t *testing.T) {
+	tests := []struct {
+		consecutive int
+		every       string
+		warn        bool
+		err         bool
+		want        []string
+		absent      []string
+	}{
+		{consecutive: 0, want: []string{`.crit(lambda: "mean" < 10 )`}, absent: []string{"stateCount"}},
+		{consecutive: 1, want: []string{`.crit(lambda: "mean" < 10 )`}, absent: []string{"stateCount"}},
+		// the 1m evaluations of the 5m period count the overlapping windows again
+		{consecutive: 3, every: "1m", err: true},
+		{consecutive: 2, every: "2m", err: true},
+		{consecutive: 3, every: "5m", want: []string{
+			"\n    |stateCount(lambda: \"mean\" < 10)\n        .as('crit_count')\n    |alert()",
+			`.crit(lambda: "crit_count" >= 3 )`,
+		}},
+		{consecutive: 3, every: "5m", warn: true, want: []string{
+			"\n    |stateCount(lambda: \"mean\" < 20)\n        .as('warn_count')" +
+				"\n    |stateCount(lambda: \"mean\" < 10)\n        .as('crit_count')",
+			`.warn(lambda: "warn_count" >= 3 )`,
+			`.crit(lambda: "crit_count" >= 3 )`,
+		}},
+	}
+	unchanged, err := genTestTick(testAlarm("loda__cpu__1"))
+	if err != nil {
+		t.Fatalf("gen tick failed: %s", err)
+	}
+	for _, tt := range tests {
+		alarm := testAlarm("loda__cpu__1")
+		alarm.Consecutive = tt.consecutive
+		if tt.every != "" {
+			alarm.Every = tt.every
+		}
+		if tt.warn {
+			alarm.WarnValue = "20"
+		}
+		tick, err := genTestTick(alarm)
+		if tt.err {
+			if err == nil || !strings.Contains(err.Error(), "equal to period") {
+				t.Errorf("consecutive %d every %s: got error %v, want equal to period", tt.consecutive, tt.every, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("consecutive %d: gen tick failed: %s", tt.consecutive, err)
+			continue
+		}
+		if tt.consecutive <= 1 && tick != unchanged {
+			t.Errorf("consecutive %d: got script:\n%s\nwant unchanged:\n%s", tt.consecutive, tick, unchanged)
+		}
+		for _, s := range tt.want {
+			if !strings.Contains(tick, s) {
+				t.Errorf("consecutive %d warn %v: script doesn't contain %q:\n%s", tt.consecutive, tt.warn, s, tick)
+			}
+		}
+		for _, s := range tt.absent {
+			if strings.Contains(tick, s) {
+				t.Errorf("consecutive %d warn %v: script contains %q:\n%s", tt.consecutive, tt.warn, s, tick)
+			}
+		}
+	}
+}
+
+// stateCountMax returns the max count of the stateCount node fed by the
+// batches of the 1m windows breaching the level, every and period in minutes.
+// The count goes on across the batches and resets on a point not breaching.
+func stateCountMax(breaches []bool, period, every int) int {
+	var count, max int
+	for end := period; end <= len(breaches); end += every {
+		for _, breach := range breaches[end-period : end] {
+			count++
+			if !breach {
+				count = 0
+			}
+			if count > max {
+				max = count
+			}
+		}
+	}
+	return max
+}
+
+// consecutiveMax returns the longest run of the breaching windows.
+func consecutiveMax(breaches []bool) int {
+	var run, max int
+	for _, breach := range breaches {
+		run++
+		if !breach {
+			run = 0
+		}
+		if run > max {
+			max = run
+		}
+	}
+	return max
+}
+
+func TestConsecutiveOverlap(t *testing.T) {
+	// breaching windows of the minutes
+	pattern := func(minutes ...int) []bool {
+		breaches := make([]bool, 15)
+		for _, m := range minutes {
+			breaches[m] = true
+		}
+		return breaches
+	}
+	tests := []struct {
+		every    int
+		breaches []bool
+		valid    bool
+	}{
+		// the last window of a batch and the first two of the next
+		{every: 5, breaches: pattern(4, 5, 6), valid: true},
+		{every: 5, breaches: pattern(4, 5, 12), valid: true},
+		// the 5th window is queried again by the next batch, 2 in a row count 3
+		{every: 4, breaches: pattern(4, 5)},
+		// the run is counted once per overlapping batch
+		{every: 1, breaches: pattern(0, 1, 2, 3, 4, 5)},
+	}
+	for _, tt := range tests {
+		alarm := testAlarm("loda__cpu__1")
+		alarm.Every = strconv.Itoa(tt.every) + "m"
+		alarm.Consecutive = 3
+		if err := ValidateAlarm(alarm); (err == nil) != tt.valid {
+			t.Errorf("every %dm: got validate error %v, want valid %v", tt.every, err, tt.valid)
+		}
+		counted, want := stateCountMax(tt.breaches, 5, tt.every), consecutiveMax(tt.breaches)
+		// only the accepted alarms count the windows in a row
+		if (counted == want) != tt.valid {
+			t.Errorf("every %dm: stateCount reaches %d, the windows in a row are %d", tt.every, counted, want)
+		}
+	}
+}
+
+func TestGenTickGroupBy(t *testing.T) {
+	tests := []struct {
+		groupBy string
+		want    string
+	}{
+		{groupBy: "", want: ".groupBy(time(1m,-5s))\n"},
+		{groupBy: "*", want: ".groupBy(*)\n"},
+		{groupBy: " * ", want: ".groupBy(*)\n"},
+		{groupBy: "a,b", want: ".groupBy(time(1m,-5s), 'a', 'b')\n"},
+		{groupBy: " a , b ", want: ".groupBy(time(1m,-5s), 'a', 'b')\n"},
+		{groupBy: ",", want: ".groupBy(time(1m,-5s))\n"},
+		{groupBy: "a,,b,", want: ".groupBy(time(1m,-5s), 'a', 'b')\n"},
+	}
+	for _, tt := range tests {
+		alarm := testAlarm("loda__cpu__1")
+		alarm.GroupBy = tt.groupBy
+		tick, err := genTestTick(alarm)
+		if err != nil {
+			t.Errorf("groupby %q: gen tick failed: %s", tt.groupBy, err)
+			continue
+		}
+		if !strings.Contains(tick, tt.want) {
+			t.Errorf("groupby %q: script doesn't contain %q:\n%s", tt.groupBy, tt.want, tick)
+		}
+		if strings.Contains(tick, ", )") || strings.Contains(tick, ",)") {
+			t.Errorf("groupby %q: dangling comma in script:\n%s", tt.groupBy, tick)
+		}
+	}
+	for _, groupBy := range []string{"a,*", "a,'b"} {
+		alarm := testAlarm("loda__cpu__1")
+		alarm.GroupBy = groupBy
+		if _, err := genTestTick(alarm); err == nil {
+			t.Errorf("groupby %q: want error", groupBy)
+		}
+	}
+}
+
+func TestGenTickQuoteField(t *testing.T) {
+	tests := []struct {
+		trigger  string
+		fn, args string
+		want     string
+	}{
+		{trigger: models.ThresHold, fn: "mean", want: `SELECT mean("used-percent")`},
+		{trigger: models.ThresHold, fn: "percentile", args: "95", want: `SELECT percentile("used-percent", 95)`},
+		{trigger: models.DeadMan, want: `SELECT count("used-percent")`},
+	}
+	for _, tt := range tests {
+		alarm := testAlarm("loda__cpu__1")
+		alarm.Trigger, alarm.Func, alarm.FuncArgs = tt.trigger, tt.fn, tt.args
+		alarm.Field = "used-percent"
+		tick, err := genTestTick(alarm)
+		if err != nil {
+			t.Errorf("%s %s: gen tick failed: %s", tt.trigger, tt.fn, err)
+			continue
+		}
+		if !strings.Contains(tick, tt.want) {
+			t.Errorf("%s %s: script doesn't contain %s:\n%s", tt.trigger, tt.fn, tt.want, tick)
+		}
+	}
+}
+
+func TestGenTickDeadmanThreshold(t *testing.T) {
+	tests := []struct {
+		threshold string
+		want      string
+	}{
+		{threshold: "", want: "|deadman(0.0, 1m)"},
+		{threshold: "1", want: "|deadman(1.0, 1m)"},
+		{threshold: "2.50", want: "|deadman(2.5, 1m)"},
+	}
+	for _, tt := range tests {
+		alarm := testAlarm("loda__cpu__1")
+		alarm.Trigger = models.DeadMan
+		alarm.DeadmanThreshold = tt.threshold
+		tick, err := genTestTick(alarm)
+		if err != nil {
+			t.Errorf("threshold %q: gen tick failed: %s", tt.threshold, err)
+			continue
+		}
+		if !strings.Contains(tick, tt.want) {
+			t.Errorf("threshold %q: script doesn't contain %s:\n%s", tt.threshold, tt.want, tick)
+		}
+	}
+}
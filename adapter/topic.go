@@ -0,0 +1,85 @@
+package adapter
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/influxdata/kapacitor/client/v1"
+	"github.com/lodastack/log"
+)
+
+// EnsureTopicHandlers creates or replaces the post handler of Topic on every
+// node, so the tasks publishing to the topic post the alerts to EventAddr,
+// and to FallbackEventAddr by a second handler if it's set. The node header
+// is set by the handlers in topic mode as the tasks don't post, so are
+// PostTimeout and CaptureResponse.
+// The version of the alarm is the alert id prefix in topic mode,
+// "<version>:<group>", instead of the query of the post url.
+func (k *Kapacitor) EnsureTopicHandlers(ctx context.Context) error {
+	if k.Topic == "" {
+		return nil
+	}
+	k.mu.RLock()
+	clients := make(map[string]Client, len(k.Clients))
+	for url, c := range k.Clients {
+		clients[url] = c
+	}
+	k.mu.RUnlock()
+
+	handlers := []client.TopicHandlerOptions{{
+		ID:      k.Root,
+		Kind:    "post",
+		Options: k.postOptions(k.EventAddr),
+	}}
+	if k.FallbackEventAddr != "" {
+		handlers = append(handlers, client.TopicHandlerOptions{
+			ID:      k.Root + "-fallback",
+			Kind:    "post",
+			Options: k.postOptions(k.FallbackEventAddr),
+		})
+	}
+	var errs []error
+	for url, c := range clients {
+		for _, opts := range handlers {
+			if k.NodeHeader {
+				opts = nodeHandler(opts, url)
+			}
+			err := callContext(ctx, func() error {
+				_, err := c.CreateTopicHandler(c.TopicHandlersLink(k.topic()), opts)
+				if err != nil && taskExists(err) {
+					// keep the handler up to date with the event address
+					_, err = c.ReplaceTopicHandler(c.TopicHandlerLink(k.topic(), opts.ID), opts)
+				}
+				return err
+			})
+			if err != nil {
+				log.Errorf("ensure topic handler failed node=%s topic=%s handler=%s: %s", url, k.topic(), opts.ID, err)
+				errs = append(errs, fmt.Errorf("ensure topic handler %s at %s failed: %s", opts.ID, url, err))
+			}
+		}
+	}
+	return joinErrors(errs)
+}
+
+// postOptions returns the post handler options of the event address.
+func (k *Kapacitor) postOptions(addr string) map[string]interface{} {
+	options := map[string]interface{}{"url": addr + k.envQuery("?")}
+	if k.PostTimeout > 0 {
+		options["timeout"] = k.PostTimeout.String()
+	}
+	if k.CaptureResponse {
+		options["capture-response"] = true
+	}
+	return options
+}
+
+// nodeHandler returns a copy of the handler options with the node header.
+func nodeHandler(opts client.TopicHandlerOptions, url string) client.TopicHandlerOptions {
+	options := make(map[string]interface{}, len(opts.Options)+1)
+	for k, v := range opts.Options {
+		options[k] = v
+	}
+	options["headers"] = map[string]string{nodeHeader: url}
+	opts.Options = options
+	return opts
+}
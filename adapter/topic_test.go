@@ -0,0 +1,47 @@
+package adapter
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEnsureTopicHandlers(t *testing.T) {
+	tests := []struct {
+		name string
+		opts Options
+		want map[string]map[string]interface{}
+	}{
+		{
+			name: "post",
+			opts: Options{Topic: "loda"},
+			want: map[string]map[string]interface{}{
+				"loda": {"url": "http://event"},
+			},
+		},
+		{
+			name: "timeout and capture response",
+			opts: Options{Topic: "loda", PostTimeout: 3 * time.Second, CaptureResponse: true, FallbackEventAddr: "http://backup"},
+			want: map[string]map[string]interface{}{
+				"loda":          {"url": "http://event", "timeout": "3s", "capture-response": true},
+				"loda-fallback": {"url": "http://backup", "timeout": "3s", "capture-response": true},
+			},
+		},
+	}
+	for _, tt := range tests {
+		k, fakes := newTestKapacitor(t, tt.opts, testAddrs[0])
+		if err := k.EnsureTopicHandlers(context.Background()); err != nil {
+			t.Fatalf("%s: ensure topic handlers failed: %s", tt.name, err)
+		}
+		got := make(map[string]map[string]interface{})
+		for _, f := range fakes {
+			for _, h := range f.handlers {
+				got[h.ID] = h.Options
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got handlers %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
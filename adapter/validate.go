@@ -0,0 +1,348 @@
+package adapter
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lodastack/models"
+)
+
+// TICK duration literal, e.g. 10s, 5m, 1d
+var durationReg = regexp.MustCompile(`^(\d+)(u|µ|ms|s|m|h|d|w)$`)
+
+var durationUnits = map[string]time.Duration{
+	"u":  time.Microsecond,
+	"µ":  time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+	"d":  24 * time.Hour,
+	"w":  7 * 24 * time.Hour,
+}
+
+// parseDuration parses a TICK duration literal.
+func parseDuration(s string) (time.Duration, error) {
+	m := durationReg.FindStringSubmatch(s)
+	if m == nil {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	n, err := strconv.ParseInt(m[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return time.Duration(n) * durationUnits[m[2]], nil
+}
+
+// parseClock parses the time of the alarm time window, an hour 0 to 23 or HH:MM,
+// returns the minute of the day and whether the minute is given.
+func parseClock(s string) (int, bool, error) {
+	bad := fmt.Errorf("invalid time %q, want hour 0 to 23 or HH:MM", s)
+	hour, minute := s, ""
+	i := strings.Index(s, ":")
+	if i >= 0 {
+		hour, minute = s[:i], s[i+1:]
+	}
+	h, err := strconv.Atoi(hour)
+	if err != nil || h < 0 || h > 23 {
+		return 0, false, bad
+	}
+	if i < 0 {
+		return h * 60, false, nil
+	}
+	m, err := strconv.Atoi(minute)
+	if err != nil || len(minute) != 2 || m < 0 || m > 59 {
+		return 0, false, bad
+	}
+	return h*60 + m, true, nil
+}
+
+// InfluxQL functions allowed in threshold alarms
+var allowedFuncs = map[string]bool{
+	"count":      true,
+	"distinct":   true,
+	"integral":   true,
+	"mean":       true,
+	"median":     true,
+	"mode":       true,
+	"spread":     true,
+	"stddev":     true,
+	"sum":        true,
+	"bottom":     true,
+	"first":      true,
+	"last":       true,
+	"max":        true,
+	"min":        true,
+	"percentile": true,
+	"sample":     true,
+	"top":        true,
+}
+
+// comparison operators of the alert lambdas
+var allowedExpressions = map[string]bool{
+	">":  true,
+	"<":  true,
+	">=": true,
+	"<=": true,
+	"==": true,
+	"!=": true,
+}
+
+// comma separated numbers, e.g. 95 or 3, 0.5
+var funcArgsReg = regexp.MustCompile(`^\d+(\.\d+)?(\s*,\s*\d+(\.\d+)?)*$`)
+
+// plain decimal number, the thresholds are put into the lambdas as they are
+var numberReg = regexp.MustCompile(`^-?\d+(\.\d+)?$`)
+
+// field name of the measurement
+var fieldReg = regexp.MustCompile(`^[A-Za-z0-9_.\-]+$`)
+
+type alarmField struct {
+	name  string
+	value string
+}
+
+// ValidateAlarm checks the alarm fields used to generate the TICK script,
+// the error names the bad field.
+func ValidateAlarm(alarm Alarm) error {
+	required := []alarmField{
+		{"version", alarm.Version},
+		{"db", alarm.DB},
+		{"rp", alarm.RP},
+		{"measurement", alarm.Measurement},
+		{"period", alarm.Period},
+		{"every", alarm.Every},
+	}
+	switch alarm.Trigger {
+	case models.ThresHold:
+		required = append(required, alarmField{"func", alarm.Func})
+		fallthrough
+	case models.Relative, TriggerDerivative:
+		required = append(required,
+			alarmField{"expression", alarm.Expression},
+			alarmField{"value", alarm.Value})
+	case models.DeadMan:
+	default:
+		return fmt.Errorf("alarm %s: unknown trigger %q", alarm.Version, alarm.Trigger)
+	}
+	for _, f := range required {
+		if f.value == "" {
+			return fmt.Errorf("alarm %s: %s is empty", alarm.Version, f.name)
+		}
+	}
+
+	// kapacitor fails the task with a bad operator in the lambda
+	for _, f := range []alarmField{
+		{"expression", alarm.Expression},
+		{"warnexpression", alarm.WarnExpression},
+	} {
+		if alarm.Trigger != models.DeadMan && f.value != "" && !allowedExpressions[f.value] {
+			return fmt.Errorf("alarm %s: %s %q is not one of > < >= <= == !=", alarm.Version, f.name, f.value)
+		}
+	}
+
+	if alarm.Trigger == models.ThresHold {
+		if !allowedFuncs[alarm.Func] {
+			return fmt.Errorf("alarm %s: func %q is not allowed", alarm.Version, alarm.Func)
+		}
+		if alarm.FuncArgs != "" && !funcArgsReg.MatchString(alarm.FuncArgs) {
+			return fmt.Errorf("alarm %s: invalid func args %q", alarm.Version, alarm.FuncArgs)
+		}
+	}
+
+	if alarm.Trigger == TriggerDerivative {
+		if alarm.Func != "" && !allowedFuncs[alarm.Func] {
+			return fmt.Errorf("alarm %s: func %q is not allowed", alarm.Version, alarm.Func)
+		}
+		// the rate is between the time windows of a batch
+		if groupByAll(alarm) {
+			return fmt.Errorf("alarm %s: derivative trigger needs group by time", alarm.Version)
+		}
+		if alarm.DerivativeUnit != "" {
+			if _, err := parseDuration(alarm.DerivativeUnit); err != nil {
+				return fmt.Errorf("alarm %s: derivative unit: %s", alarm.Version, err)
+			}
+		}
+	}
+
+	if alarm.Trigger == models.Relative {
+		switch alarm.RelativeMode {
+		case "", RelativeMaxMin, RelativeLastFirst, RelativePercent:
+		case RelativeMean:
+			// difference of the window means needs the time windows
+			if groupByAll(alarm) {
+				return fmt.Errorf("alarm %s: relative mode %q needs group by time", alarm.Version, alarm.RelativeMode)
+			}
+		default:
+			return fmt.Errorf("alarm %s: unknown relative mode %q", alarm.Version, alarm.RelativeMode)
+		}
+	}
+
+	if alarm.Trigger != models.DeadMan {
+		for _, f := range []alarmField{{"value", alarm.Value}, {"warnvalue", alarm.WarnValue}} {
+			if f.value == "" {
+				continue
+			}
+			if _, err := strconv.ParseFloat(f.value, 64); err != nil || !numberReg.MatchString(f.value) {
+				return fmt.Errorf("alarm %s: %s %q is not a number", alarm.Version, f.name, f.value)
+			}
+		}
+	}
+
+	// the tags are single quoted in the groupBy
+	for _, tag := range groupByTags(alarm) {
+		if tag == "*" || strings.ContainsAny(tag, "'\\\n") {
+			return fmt.Errorf("alarm %s: invalid group by tag %q", alarm.Version, tag)
+		}
+	}
+
+	// the alert tags are single quoted in the default node
+	for name, value := range alarm.AlertTags {
+		if name == "" || strings.ContainsAny(name, "'\\\n") || strings.ContainsAny(value, "'\\\n") {
+			return fmt.Errorf("alarm %s: invalid alert tag %q=%q", alarm.Version, name, value)
+		}
+	}
+
+	if alarm.Consecutive < 0 {
+		return fmt.Errorf("alarm %s: consecutive %d is negative", alarm.Version, alarm.Consecutive)
+	}
+
+	if alarm.Field != "" && !fieldReg.MatchString(alarm.Field) {
+		return fmt.Errorf("alarm %s: invalid field %q", alarm.Version, alarm.Field)
+	}
+
+	if alarm.FlappingLow != "" || alarm.FlappingHigh != "" {
+		low, errLow := strconv.ParseFloat(alarm.FlappingLow, 64)
+		high, errHigh := strconv.ParseFloat(alarm.FlappingHigh, 64)
+		if errLow != nil || errHigh != nil || low < 0 || high > 1 || low >= high {
+			return fmt.Errorf("alarm %s: invalid flapping %q %q, want 0 <= low < high <= 1",
+				alarm.Version, alarm.FlappingLow, alarm.FlappingHigh)
+		}
+	}
+
+	for _, m := range alarm.Measurements {
+		if m == "" {
+			return fmt.Errorf("alarm %s: measurements has an empty one", alarm.Version)
+		}
+	}
+
+	// the where clause and identifiers are put into the triple quoted query literal
+	idents := []alarmField{
+		{"where", alarm.Where},
+		{"db", alarm.DB},
+		{"rp", alarm.RP},
+		{"measurement", alarm.Measurement},
+	}
+	for _, m := range alarm.Measurements {
+		idents = append(idents, alarmField{"measurements", m})
+	}
+	for _, f := range idents {
+		if strings.Contains(f.value, "'''") {
+			return fmt.Errorf("alarm %s: %s must not contain '''", alarm.Version, f.name)
+		}
+	}
+
+	// message is put into a single quoted literal, details into a triple quoted one
+	if strings.ContainsAny(alarm.Message, "'\\\n") {
+		return fmt.Errorf("alarm %s: message must not contain quote, backslash or newline", alarm.Version)
+	}
+	if strings.Contains(alarm.Details, "'''") || strings.HasSuffix(alarm.Details, "'") {
+		return fmt.Errorf("alarm %s: details must not contain ''' or end with '", alarm.Version)
+	}
+
+	// a bad time would generate a lambda never matches and silence the alarm
+	if alarm.STime != "" {
+		if _, _, err := parseClock(alarm.STime); err != nil {
+			return fmt.Errorf("alarm %s: stime: %s", alarm.Version, err)
+		}
+	}
+	if alarm.ETime != "" {
+		if _, _, err := parseClock(alarm.ETime); err != nil {
+			return fmt.Errorf("alarm %s: etime: %s", alarm.Version, err)
+		}
+	}
+
+	for _, d := range alarm.Weekdays {
+		if d < 0 || d > 6 {
+			return fmt.Errorf("alarm %s: weekday %d, want 0 (Sunday) to 6", alarm.Version, d)
+		}
+	}
+	for _, w := range alarm.Maintenance {
+		if _, _, err := parseClock(w.Start); err != nil {
+			return fmt.Errorf("alarm %s: maintenance start: %s", alarm.Version, err)
+		}
+		if _, _, err := parseClock(w.End); err != nil {
+			return fmt.Errorf("alarm %s: maintenance end: %s", alarm.Version, err)
+		}
+		for _, d := range w.Weekdays {
+			if d < 0 || d > 6 {
+				return fmt.Errorf("alarm %s: maintenance weekday %d, want 0 (Sunday) to 6", alarm.Version, d)
+			}
+		}
+	}
+
+	switch alarm.Handler {
+	case "", HandlerPost:
+	case HandlerTCP, HandlerExec, HandlerTopic:
+		// the target is put into a single quoted literal
+		if alarm.HandlerTarget == "" || strings.ContainsAny(alarm.HandlerTarget, "'\\\n") {
+			return fmt.Errorf("alarm %s: invalid %s handler target %q", alarm.Version, alarm.Handler, alarm.HandlerTarget)
+		}
+	default:
+		return fmt.Errorf("alarm %s: unknown handler %q", alarm.Version, alarm.Handler)
+	}
+
+	period, err := parseDuration(alarm.Period)
+	if err != nil {
+		return fmt.Errorf("alarm %s: period: %s", alarm.Version, err)
+	}
+	every, err := parseDuration(alarm.Every)
+	if err != nil {
+		return fmt.Errorf("alarm %s: every: %s", alarm.Version, err)
+	}
+	// the data between the queries is never checked if every > period
+	if every > period {
+		return fmt.Errorf("alarm %s: every %s is longer than period %s", alarm.Version, alarm.Every, alarm.Period)
+	}
+	// stateCount keeps counting across the batches, the overlapping windows
+	// of every < period would be counted again
+	if alarm.Consecutive > 1 && every != period {
+		return fmt.Errorf("alarm %s: consecutive %d needs every %s equal to period %s",
+			alarm.Version, alarm.Consecutive, alarm.Every, alarm.Period)
+	}
+	if alarm.Window != "" {
+		if _, err := parseDuration(alarm.Window); err != nil {
+			return fmt.Errorf("alarm %s: window: %s", alarm.Version, err)
+		}
+	}
+	if alarm.Offset != "" {
+		if _, err := parseDuration(alarm.Offset); err != nil {
+			return fmt.Errorf("alarm %s: offset: %s", alarm.Version, err)
+		}
+	}
+	if alarm.Stagger != "" {
+		d, err := parseDuration(alarm.Stagger)
+		if err != nil {
+			return fmt.Errorf("alarm %s: stagger: %s", alarm.Version, err)
+		}
+		if d <= 0 || d >= time.Minute || d%time.Second != 0 {
+			return fmt.Errorf("alarm %s: stagger %s is not whole seconds under 1m", alarm.Version, alarm.Stagger)
+		}
+	}
+	if alarm.DeadmanThreshold != "" {
+		threshold, err := strconv.ParseFloat(alarm.DeadmanThreshold, 64)
+		if err != nil || threshold < 0 || math.IsNaN(threshold) || math.IsInf(threshold, 0) {
+			return fmt.Errorf("alarm %s: deadman threshold %q is not a non-negative number", alarm.Version, alarm.DeadmanThreshold)
+		}
+	}
+	if alarm.DeadmanInterval != "" {
+		if _, err := parseDuration(alarm.DeadmanInterval); err != nil {
+			return fmt.Errorf("alarm %s: deadman interval: %s", alarm.Version, err)
+		}
+	}
+	return nil
+}
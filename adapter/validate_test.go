@@ -0,0 +1,84 @@
+package adapter
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/lodastack/models"
+)
+
+func TestValidateEveryPeriod(t *testing.T) {
+	tests := []struct {
+		period, every string
+		err           string
+	}{
+		{period: "5m", every: "1m"},
+		{period: "5m", every: "5m"},
+		{period: "1h", every: "90s"},
+		{period: "1m", every: "5m", err: "every 5m is longer than period 1m"},
+		{period: "59s", every: "1m", err: "longer than period"},
+		{period: "5x", every: "1m", err: "period"},
+		{period: "5m", every: "", err: "every is empty"},
+		{period: "5m", every: "-1m", err: "every"},
+	}
+	for _, tt := range tests {
+		alarm := testAlarm("loda__cpu__1")
+		alarm.Period, alarm.Every = tt.period, tt.every
+		err := ValidateAlarm(alarm)
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("period %q every %q: %s", tt.period, tt.every, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("period %q every %q: got error %v, want %q", tt.period, tt.every, err, tt.err)
+		}
+		// genTick fails too, so CreateTask creates nothing
+		if _, err := genTestTick(alarm); err == nil {
+			t.Errorf("period %q every %q: gen tick succeeded", tt.period, tt.every)
+		}
+	}
+}
+
+func TestValidateThresholds(t *testing.T) {
+	tests := []struct {
+		trigger          string
+		value, warnValue string
+		deadmanThreshold string
+		err              string
+	}{
+		{trigger: models.ThresHold, value: "90", warnValue: "80.5"},
+		{trigger: models.ThresHold, value: "-1.5"},
+		{trigger: models.ThresHold, value: "10 OR TRUE", err: "value"},
+		{trigger: models.ThresHold, value: "90) |httpOut('x'", err: "value"},
+		{trigger: models.ThresHold, value: "90", warnValue: "80 OR TRUE", err: "warnvalue"},
+		{trigger: models.ThresHold, value: "NaN", err: "value"},
+		{trigger: models.ThresHold, value: "1e3", err: "value"},
+		{trigger: models.Relative, value: "50", warnValue: "x", err: "warnvalue"},
+		{trigger: TriggerDerivative, value: "inf", err: "value"},
+		{trigger: models.DeadMan},
+		{trigger: models.DeadMan, deadmanThreshold: "2.5"},
+		{trigger: models.DeadMan, deadmanThreshold: "-1", err: "deadman threshold"},
+		{trigger: models.DeadMan, deadmanThreshold: "NaN", err: "deadman threshold"},
+		{trigger: models.DeadMan, deadmanThreshold: "0, 1m) |httpOut('x'", err: "deadman threshold"},
+	}
+	for _, tt := range tests {
+		alarm := testAlarm("loda__cpu__1")
+		alarm.Trigger, alarm.Value, alarm.WarnValue = tt.trigger, tt.value, tt.warnValue
+		alarm.DeadmanThreshold = tt.deadmanThreshold
+		if tt.trigger == TriggerDerivative {
+			alarm.Func = ""
+		}
+		err := ValidateAlarm(alarm)
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("%s %q %q %q: %s", tt.trigger, tt.value, tt.warnValue, tt.deadmanThreshold, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s %q %q %q: got error %v, want %q", tt.trigger, tt.value, tt.warnValue, tt.deadmanThreshold, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package adapter
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/influxdata/kapacitor/client/v1"
+	"github.com/lodastack/log"
+)
+
+// thresholdVars returns the crit and warn vars of the alarm's thresholds.
+func thresholdVars(alarm Alarm) client.Vars {
+	vars := make(client.Vars)
+	for name, value := range map[string]string{"crit": alarm.Value, "warn": alarm.WarnValue} {
+		if value == "" {
+			continue
+		}
+		f, _ := strconv.ParseFloat(value, 64)
+		vars[name] = client.Var{Type: client.VarFloat, Value: f}
+	}
+	return vars
+}
+
+// taskVars returns the vars the task of the alarm is created with,
+// so the thresholds show up in the kapacitor UI, nil unless VarThreshold.
+func taskVars(alarm Alarm) client.Vars {
+	if !alarm.VarThreshold {
+		return nil
+	}
+	return thresholdVars(alarm)
+}
+
+// sameVars reports whether the task vars got are the wanted ones.
+func sameVars(want, got client.Vars) bool {
+	if len(want) != len(got) {
+		return false
+	}
+	for name, w := range want {
+		g, ok := got[name]
+		if !ok || g.Type != w.Type || g.Value != w.Value {
+			return false
+		}
+	}
+	return true
+}
+
+// declarations of the threshold vars by genVars
+var thresholdVarsReg = regexp.MustCompile(`(?m)^var (crit|warn) = [-0-9.]+\n`)
+
+// stripVars removes the threshold var declarations from tick, the task vars
+// override them and are compared on their own.
+func stripVars(tick string) string {
+	return thresholdVarsReg.ReplaceAllString(tick, "")
+}
+
+// UpdateVars sets the threshold vars of the alarm's task to its Value and
+// WarnValue without replacing the TICK script, the alarm must be
+// VarThreshold. The vars override the declarations in the script.
+func (k *Kapacitor) UpdateVars(alarm Alarm) error {
+	return k.UpdateVarsContext(context.Background(), alarm)
+}
+
+func (k *Kapacitor) UpdateVarsContext(ctx context.Context, alarm Alarm) (err error) {
+	defer k.count(func(s *Stats) {
+		if err != nil {
+			s.UpdateFailures++
+		} else {
+			s.Updated++
+		}
+	})
+	if !alarm.VarThreshold {
+		return fmt.Errorf("alarm %s: thresholds are not vars", alarm.Version)
+	}
+	if err := ValidateAlarm(alarm); err != nil {
+		return err
+	}
+
+	k.setHashKey(alarm)
+	url, err := k.hashKapacitor(taskID(alarm))
+	if err != nil {
+		log.Errorf("hash task failed %s: %s", alarmFields(alarm, ""), err)
+		return err
+	}
+	k.mu.RLock()
+	c, ok := k.Clients[url]
+	k.mu.RUnlock()
+	if !ok {
+		log.Errorf("get cache kapacitor client failed %s", alarmFields(alarm, url))
+		return fmt.Errorf("get cache kapacitor %s client failed", url)
+	}
+	log.Infof("update task vars %s", alarmFields(alarm, url))
+	err = callContext(ctx, func() error {
+		_, err := c.UpdateTask(c.TaskLink(taskID(alarm)), client.UpdateTaskOptions{
+			Vars: thresholdVars(alarm),
+		})
+		return err
+	})
+	if err != nil {
+		log.Errorf("update task vars failed %s: %s", alarmFields(alarm, url), err)
+	}
+	return err
+}
@@ -8,6 +8,7 @@ import (
 	"runtime/pprof"
 	"strconv"
 	"syscall"
+	"time"
 
 	"github.com/lodastack/alarm-adapter/APIStatus"
 	"github.com/lodastack/alarm-adapter/adapter"
@@ -19,6 +20,9 @@ import (
 	"github.com/oiooj/cli"
 )
 
+// shutdownTimeout bounds the wait of the in-flight task changes on exit.
+const shutdownTimeout = 10 * time.Second
+
 var logBackend *log.FileBackend
 
 var CmdStart = cli.Command{
@@ -83,6 +87,9 @@ func Notify() {
 	signal.Notify(message, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGKILL, os.Interrupt)
 	<-message
 	log.Info("receive signal, exit...")
+	if err := adapter.Stop(shutdownTimeout); err != nil {
+		log.Errorf("stop alarm adapter error: %s", err)
+	}
 	logBackend.Flush()
 	stopProfile()
 	os.Exit(0)
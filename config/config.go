@@ -46,6 +46,49 @@ type AlarmConfig struct {
 	Enable    bool   `toml:"enable"`
 	NS        string `toml:"NS"`
 	EventAddr string `toml:"eventAddr"`
+	Timeout   int    `toml:"timeout"`
+
+	TLS                bool   `toml:"tls"`
+	InsecureSkipVerify bool   `toml:"insecureSkipVerify"`
+	CACert             string `toml:"caCert"`
+	Cert               string `toml:"cert"`
+	Key                string `toml:"key"`
+
+	Username string `toml:"username"`
+	Password string `toml:"password"`
+	Token    string `toml:"token"`
+
+	UserAgent string `toml:"userAgent"`
+
+	MaxConcurrency int `toml:"maxConcurrency"`
+	MaxAttempts    int `toml:"maxAttempts"`
+	RetryDelay     int `toml:"retryDelay"`
+
+	HealthCheckInterval int `toml:"healthCheckInterval"`
+
+	Replicas int            `toml:"replicas"`
+	Weights  map[string]int `toml:"weights"`
+
+	Root     string `toml:"root"`
+	Timezone string `toml:"timezone"`
+	FailOpen bool   `toml:"failOpen"`
+
+	PostTimeout     int  `toml:"postTimeout"`
+	CaptureResponse bool `toml:"captureResponse"`
+	GroupID         bool `toml:"groupID"`
+
+	Jitter int    `toml:"jitter"`
+	Topic  string `toml:"topic"`
+
+	HashKey      string `toml:"hashKey"`
+	VerifyCreate bool   `toml:"verifyCreate"`
+	Offset       string `toml:"offset"`
+
+	FallbackEventAddr string `toml:"fallbackEventAddr"`
+	NodeHeader        bool   `toml:"nodeHeader"`
+	RemoveOwnerOnly   bool   `toml:"removeOwnerOnly"`
+	Stagger           bool   `toml:"stagger"`
+	Environment       string `toml:"environment"`
 }
 
 type PingConfig struct {